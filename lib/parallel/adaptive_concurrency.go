@@ -0,0 +1,219 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// DefaultAdaptiveInterval is the default interval at which the
+// system load is sampled to adapt the concurrency.
+const DefaultAdaptiveInterval = 5 * time.Second
+
+const (
+	// maxLoadPerCPU is the load average per CPU above which
+	// the concurrency is lowered.
+	maxLoadPerCPU = 1.0
+	// lowLoadPerCPU is the load average per CPU below which
+	// the concurrency can be raised.
+	lowLoadPerCPU = 0.7
+	// maxCPUPressure and lowCPUPressure are the percentages of time
+	// that some tasks were stalled on CPU over the last 10 seconds
+	// above which the concurrency is lowered, and below which it
+	// can be raised.
+	maxCPUPressure = 25.0
+	lowCPUPressure = 10.0
+	// maxMemoryPressure and lowMemoryPressure are the same as
+	// maxCPUPressure and lowCPUPressure for memory.
+	maxMemoryPressure = 10.0
+	lowMemoryPressure = 1.0
+)
+
+// AdaptiveConcurrency says how to adapt the maximum number of
+// concurrent commands to the load of the system.
+//
+// The load is read from /proc/loadavg, and from /proc/pressure for
+// Linux kernels with pressure stall information. If neither can be
+// read, the concurrency stays at its initial value.
+type AdaptiveConcurrency struct {
+	// MinConcurrentCmds is the lowest the concurrency is lowered to,
+	// and must be at least 1.
+	MinConcurrentCmds int
+	// MaxConcurrentCmds is the highest the concurrency is raised to,
+	// and must be at least MinConcurrentCmds.
+	MaxConcurrentCmds int
+	// Interval is how often the load is sampled. If 0,
+	// DefaultAdaptiveInterval is used.
+	Interval time.Duration
+}
+
+// systemLoad is a sample of the load of the system.
+type systemLoad struct {
+	// LoadPerCPU is the 1 minute load average divided by the
+	// number of CPUs.
+	LoadPerCPU float64
+	// CPUPressure and MemoryPressure are the percentages of time
+	// some tasks were stalled on CPU and memory over the last 10
+	// seconds, or 0 if not known.
+	CPUPressure    float64
+	MemoryPressure float64
+}
+
+func validateAdaptiveConcurrency(adaptiveConcurrency *AdaptiveConcurrency) error {
+	if adaptiveConcurrency.MinConcurrentCmds < 1 {
+		return fmt.Errorf("adaptive min concurrent commands must be at least 1: %d", adaptiveConcurrency.MinConcurrentCmds)
+	}
+	if adaptiveConcurrency.MaxConcurrentCmds < adaptiveConcurrency.MinConcurrentCmds {
+		return fmt.Errorf(
+			"adaptive max concurrent commands must be at least min concurrent commands %d: %d",
+			adaptiveConcurrency.MinConcurrentCmds,
+			adaptiveConcurrency.MaxConcurrentCmds,
+		)
+	}
+	if adaptiveConcurrency.Interval < 0 {
+		return fmt.Errorf("adaptive interval is negative: %v", adaptiveConcurrency.Interval)
+	}
+	return nil
+}
+
+// getInitialConcurrency returns the concurrency to start with, which
+// is the number of CPUs within the bounds.
+func getInitialConcurrency(adaptiveConcurrency *AdaptiveConcurrency) int {
+	return clampConcurrency(runtime.NumCPU(), adaptiveConcurrency)
+}
+
+// adaptConcurrency samples the load of the system at every interval
+// and sets the limit of the semaphore accordingly, until doneC is
+// closed.
+func (r *runner) adaptConcurrency(semaphore *semaphore, limit int, doneC <-chan struct{}) {
+	interval := r.AdaptiveConcurrency.Interval
+	if interval == 0 {
+		interval = DefaultAdaptiveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-doneC:
+			return
+		}
+		load, err := r.ReadSystemLoad()
+		if err != nil {
+			continue
+		}
+		nextLimit := getNextConcurrency(limit, load, r.AdaptiveConcurrency)
+		if nextLimit == limit {
+			continue
+		}
+		semaphore.SetLimit(nextLimit)
+		r.EventHandler(newConcurrencyChangedEvent(r.Clock(), limit, nextLimit, load))
+		limit = nextLimit
+	}
+}
+
+// getNextConcurrency returns the concurrency to use given the load,
+// lowering it by a quarter when the system is overloaded, and raising
+// it by one when the system has spare capacity.
+func getNextConcurrency(limit int, load *systemLoad, adaptiveConcurrency *AdaptiveConcurrency) int {
+	switch {
+	case load.LoadPerCPU > maxLoadPerCPU || load.CPUPressure > maxCPUPressure || load.MemoryPressure > maxMemoryPressure:
+		decrease := limit / 4
+		if decrease < 1 {
+			decrease = 1
+		}
+		limit -= decrease
+	case load.LoadPerCPU < lowLoadPerCPU && load.CPUPressure < lowCPUPressure && load.MemoryPressure < lowMemoryPressure:
+		limit++
+	}
+	return clampConcurrency(limit, adaptiveConcurrency)
+}
+
+func clampConcurrency(limit int, adaptiveConcurrency *AdaptiveConcurrency) int {
+	if limit < adaptiveConcurrency.MinConcurrentCmds {
+		return adaptiveConcurrency.MinConcurrentCmds
+	}
+	if limit > adaptiveConcurrency.MaxConcurrentCmds {
+		return adaptiveConcurrency.MaxConcurrentCmds
+	}
+	return limit
+}
+
+// readSystemLoad reads the load of the system from /proc.
+func readSystemLoad() (*systemLoad, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	fields := bytes.Fields(data)
+	if len(fields) == 0 {
+		return nil, errors.New("/proc/loadavg is empty")
+	}
+	loadAverage, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &systemLoad{
+		LoadPerCPU: loadAverage / float64(runtime.NumCPU()),
+		// pressure stall information is not available on all kernels
+		CPUPressure:    readPressure("/proc/pressure/cpu"),
+		MemoryPressure: readPressure("/proc/pressure/memory"),
+	}, nil
+}
+
+// readPressure returns the avg10 of the "some" line of the pressure
+// stall information file, or 0 if it cannot be read.
+func readPressure(filePath string) float64 {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return 0
+	}
+	return parsePressure(data)
+}
+
+// parsePressure parses the avg10 of the "some" line of pressure
+// stall information such as
+// "some avg10=1.23 avg60=0.50 avg300=0.10 total=12345".
+func parsePressure(data []byte) float64 {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) < 2 || string(fields[0]) != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if !bytes.HasPrefix(field, []byte("avg10=")) {
+				continue
+			}
+			pressure, err := strconv.ParseFloat(string(field[len("avg10="):]), 64)
+			if err != nil {
+				return 0
+			}
+			return pressure
+		}
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetNextConcurrency(t *testing.T) {
+	adaptiveConcurrency := &AdaptiveConcurrency{MinConcurrentCmds: 2, MaxConcurrentCmds: 16}
+	for _, tt := range []struct {
+		name     string
+		limit    int
+		load     systemLoad
+		expected int
+	}{
+		{"idle", 8, systemLoad{LoadPerCPU: 0.2}, 9},
+		{"idle at max", 16, systemLoad{LoadPerCPU: 0.2}, 16},
+		{"busy", 8, systemLoad{LoadPerCPU: 0.9}, 8},
+		{"overloaded", 8, systemLoad{LoadPerCPU: 1.5}, 6},
+		{"overloaded at min", 2, systemLoad{LoadPerCPU: 1.5}, 2},
+		{"cpu pressure", 8, systemLoad{LoadPerCPU: 0.2, CPUPressure: 30}, 6},
+		{"memory pressure", 3, systemLoad{LoadPerCPU: 0.2, MemoryPressure: 20}, 2},
+		{"some memory pressure", 8, systemLoad{LoadPerCPU: 0.2, MemoryPressure: 5}, 8},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			load := tt.load
+			assert.Equal(t, tt.expected, getNextConcurrency(tt.limit, &load, adaptiveConcurrency))
+		})
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	assert.Equal(t, 1.23, parsePressure([]byte(
+		"some avg10=1.23 avg60=0.50 avg300=0.10 total=12345\n"+
+			"full avg10=0.50 avg60=0.20 avg300=0.05 total=1234\n",
+	)))
+	assert.Equal(t, 0.0, parsePressure([]byte("")))
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(1, "1", 0),
+		newSimpleCmd(1, "2", 0),
+		newSimpleCmd(1, "3", 0),
+	}
+	// the concurrency starts at the number of CPUs
+	numCPU := runtime.NumCPU()
+	testEnv := newTestEnv(0, cmds, WithAdaptiveConcurrency(AdaptiveConcurrency{
+		MinConcurrentCmds: 1,
+		MaxConcurrentCmds: numCPU + 2,
+		Interval:          10 * time.Millisecond,
+	}))
+	testEnv.runner.ReadSystemLoad = func() (*systemLoad, error) {
+		return &systemLoad{LoadPerCPU: 0.1}, nil
+	}
+	require.NoError(t, testEnv.run())
+
+	events := testEnv.eventHandler.EventsForType(EventTypeConcurrencyChanged)
+	require.Len(t, events, 2)
+	require.Equal(t, numCPU, events[0].Fields["previous_max_concurrent_cmds"])
+	require.Equal(t, numCPU+1, events[0].Fields["max_concurrent_cmds"])
+	require.Equal(t, numCPU+2, events[1].Fields["max_concurrent_cmds"])
+	require.Equal(t, 0.1, events[0].Fields["load_per_cpu"])
+}
+
+func TestAdaptiveConcurrencyInvalid(t *testing.T) {
+	runner := newRunner(WithAdaptiveConcurrency(AdaptiveConcurrency{MinConcurrentCmds: 2, MaxConcurrentCmds: 1}))
+	require.EqualError(
+		t,
+		runner.Run(nil),
+		"adaptive max concurrent commands must be at least min concurrent commands 2: 1",
+	)
+}
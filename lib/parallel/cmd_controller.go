@@ -21,78 +21,495 @@
 package parallel
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"os/exec"
 	"sync"
 	"time"
 )
 
-var errCmdFailed = errors.New("command failed")
+const (
+	stopStageSignal = "signal"
+	stopStageKill   = "kill"
+
+	// killWaitTimeout is how long to wait for a killed command to exit.
+	killWaitTimeout = 100 * time.Millisecond
+)
+
+var (
+	errCmdFailed   = errors.New("command failed")
+	errCmdTimedOut = errors.New("command timed out")
+
+	errCmdNotStarted      = errors.New("run stopped before the command started")
+	errSignalNotSupported = errors.New("command does not support signals")
+)
+
+// cmdConfig is the configuration for a single command.
+type cmdConfig struct {
+	// Index is the index of the command in the run.
+	Index int
+	// ID is the ID of the Task of the command.
+	ID string
+	// Name is the name of the Task of the command, if any.
+	Name string
+	// Timeout is the timeout of the command, or 0 for none.
+	Timeout time.Duration
+	// StopSignal is the signal to send before killing the
+	// command, or nil to kill the command immediately.
+	StopSignal os.Signal
+	// StopGracePeriod is how long to wait for the command to
+	// exit after sending StopSignal before killing it.
+	StopGracePeriod time.Duration
+	// ForwardGracePeriod is how long to wait for the command to
+	// exit after forwarding a signal to it before killing it.
+	ForwardGracePeriod time.Duration
+	// RetryPolicy is the retry policy, or nil to never retry.
+	RetryPolicy *RetryPolicy
+	// Output is the output to redirect the command to, or nil
+	// to leave the output of the command as is.
+	Output Output
+}
 
 type cmdController struct {
 	Cmd          Cmd
+	Config       cmdConfig
 	EventHandler func(*Event)
 	Clock        func() time.Time
 	Started      bool
+	Running      bool
 	Finished     bool
-	StartTime    time.Time
-	Lock         sync.Mutex
+	Stopping     bool
+	TimedOut     bool
+	StoppedBy    string
+	Signal       string
+	// LimitExceeded is the limit the last attempt was killed
+	// for exceeding, if any.
+	LimitExceeded string
+	Attempt       int
+	// Pgids are the process groups of the attempts that were
+	// started in their own process group.
+	Pgids []int
+	// StartedSent is whether the cmd_started Event was sent.
+	StartedSent bool
+	StartTime   time.Time
+	Cancel      context.CancelFunc
+	Result      CmdResult
+	WaitC       chan struct{}
+	StopC       chan struct{}
+	DoneC       chan struct{}
+	Lock        sync.Mutex
 }
 
-func newCmdController(cmd Cmd, eventHandler func(*Event), clock func() time.Time) *cmdController {
-	return &cmdController{cmd, eventHandler, clock, false, false, clock(), sync.Mutex{}}
+func newCmdController(cmd Cmd, config cmdConfig, eventHandler func(*Event), clock func() time.Time) *cmdController {
+	return &cmdController{
+		cmd,
+		config,
+		eventHandler,
+		clock,
+		false,
+		false,
+		false,
+		false,
+		false,
+		"",
+		"",
+		"",
+		0,
+		nil,
+		false,
+		clock(),
+		nil,
+		CmdResult{Cmd: cmd, ID: config.ID, Name: config.Name, ExitCode: -1},
+		nil,
+		make(chan struct{}),
+		make(chan struct{}),
+		sync.Mutex{},
+	}
 }
 
-// Run returns false on failure that has not been already handled
-func (c *cmdController) Run() bool {
+// Run returns errCmdFailed or errCmdTimedOut on failure that
+// has not been already handled
+func (c *cmdController) Run(ctx context.Context) error {
 	c.Lock.Lock()
 	if c.Started || c.Finished {
 		c.Lock.Unlock()
-		return true
+		return nil
 	}
 	c.Started = true
 	c.StartTime = c.Clock()
-	c.EventHandler(newCmdStartedEvent(c.StartTime, c.Cmd))
-	if err := c.Cmd.Start(); err != nil {
+	ctx, c.Cancel = context.WithCancel(ctx)
+	defer c.Cancel()
+	if outputCmd, ok := c.Cmd.(OutputCmd); ok && c.Config.Output != nil {
+		outputCmd.SetOutput(c.Config.Output.Start(CmdInfo{c.Config.Index, c.Config.ID, c.Config.Name, c.Cmd}))
+	}
+	c.Lock.Unlock()
+	for {
+		exitCode, err := c.runAttempt(ctx)
 		finishTime := c.Clock()
-		err = fmt.Errorf("command could not start: %v: %v", c.Cmd, err)
-		c.Finished = true
-		c.EventHandler(newCmdFinishedEvent(finishTime, c.Cmd, c.StartTime, err))
+		c.Lock.Lock()
+		// if the command is stopping, Kill will finish it
+		if c.Finished || c.Stopping {
+			c.Lock.Unlock()
+			return nil
+		}
+		if c.TimedOut {
+			err = fmt.Errorf("command timed out after %v: %v", c.Config.Timeout, c.Cmd)
+			c.finish(finishTime, -1, true, err)
+			c.Lock.Unlock()
+			return errCmdTimedOut
+		}
+		_, retryable := c.Cmd.(RetryableCmd)
+		if err == nil || !retryable || !c.Config.RetryPolicy.shouldRetry(c.Attempt, exitCode) {
+			c.finish(finishTime, exitCode, false, err)
+			c.Lock.Unlock()
+			if err != nil {
+				return errCmdFailed
+			}
+			return nil
+		}
+		backoff := c.Config.RetryPolicy.getBackoff(c.Attempt)
+		c.EventHandler(newCmdRetriedEvent(finishTime, c.Cmd, c.getEventCmd(-1), c.Attempt+1, backoff, err))
 		c.Lock.Unlock()
-		return false
+		if err := c.waitBackoff(backoff); err != nil {
+			c.Lock.Lock()
+			if !c.Finished && !c.Stopping {
+				c.finish(c.Clock(), -1, false, err)
+			}
+			c.Lock.Unlock()
+			return errCmdFailed
+		}
 	}
-	c.Lock.Unlock()
-	err := c.Cmd.Wait()
-	finishTime := c.Clock()
+}
+
+// runAttempt starts the command and waits for it, returning its exit
+// code and error.
+func (c *cmdController) runAttempt(ctx context.Context) (int, error) {
+	c.Lock.Lock()
+	if c.Stopping {
+		c.Lock.Unlock()
+		return -1, nil
+	}
+	c.Attempt++
+	c.Signal = ""
+	c.LimitExceeded = ""
+	waitC := make(chan struct{})
+	defer close(waitC)
+	c.WaitC = waitC
+	err := c.start(ctx)
+	// the event is sent once the command is started so that it
+	// contains the pid of the command
+	c.sendStartedEvent()
 	if err != nil {
+		c.Lock.Unlock()
+		return -1, fmt.Errorf("command could not start: %v: %v", c.Cmd, err)
+	}
+	c.Running = true
+	if pgidCmd, ok := c.Cmd.(pgidCmd); ok && pgidCmd.Pgid() > 0 {
+		c.Pgids = append(c.Pgids, pgidCmd.Pgid())
+	}
+	if c.Config.Timeout > 0 {
+		timer := time.AfterFunc(c.Config.Timeout, c.timeOut)
+		defer timer.Stop()
+	}
+	c.Lock.Unlock()
+	err = c.Cmd.Wait()
+	c.Lock.Lock()
+	c.Running = false
+	c.Signal = getSignal(err)
+	if limitCmd, ok := c.Cmd.(limitCmd); ok {
+		c.LimitExceeded = limitCmd.LimitExceeded()
+	}
+	c.addResourceUsage()
+	limitExceeded := c.LimitExceeded
+	c.Lock.Unlock()
+	exitCode := getExitCode(err)
+	switch {
+	case err != nil && limitExceeded != "":
+		err = fmt.Errorf("command exceeded %s limit: %v: %v", limitExceeded, c.Cmd, err)
+	case err != nil:
 		err = fmt.Errorf("command had error: %v: %v", c.Cmd, err)
 	}
+	return exitCode, err
+}
+
+// waitBackoff waits for the backoff and then resets the command
+// so that it can be started again. Return nil without resetting
+// the command if it is stopped while waiting.
+func (c *cmdController) waitBackoff(backoff time.Duration) error {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.StopC:
+		return nil
+	}
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
-	if c.Finished {
-		return true
+	if c.Stopping {
+		return nil
 	}
-	c.Finished = true
-	c.EventHandler(newCmdFinishedEvent(finishTime, c.Cmd, c.StartTime, err))
-	return err == nil
+	// Run only retries commands that implement RetryableCmd
+	if err := c.Cmd.(RetryableCmd).Reset(); err != nil {
+		return fmt.Errorf("command could not be reset: %v: %v", c.Cmd, err)
+	}
+	return nil
 }
 
-func (c *cmdController) Kill() {
+// Kill stops the command if it is running, and marks the command as
+// finished so that it will never start. If reason is not nil, the
+// finished event for a running command will contain it as an error,
+// and the killed event for a command that never started will give it
+// as the reason.
+// If forwardedSignal is not nil, it is sent to a running command
+// instead of the stop signal.
+//
+// Kill blocks until the command is stopped, which may take up to
+// the stop or forward grace period.
+func (c *cmdController) Kill(reason error, forwardedSignal os.Signal) {
 	c.Lock.Lock()
-	defer c.Lock.Unlock()
 	if !c.Started {
 		c.Started = true
 		c.Finished = true
+		close(c.DoneC)
+		if reason == nil {
+			reason = errCmdNotStarted
+		}
+		c.EventHandler(newCmdKilledEvent(c.Clock(), c.Cmd, c.getEventCmd(-1), reason))
+		c.Lock.Unlock()
 		return
 	}
-	if c.Finished {
+	if c.Finished || c.Stopping {
+		c.Lock.Unlock()
 		return
 	}
-	c.Finished = true
-	err := c.Cmd.Kill()
+	c.Stopping = true
+	close(c.StopC)
+	if isTimeoutErr(reason) && !c.TimedOut {
+		c.TimedOut = true
+		c.EventHandler(newCmdTimedOutEvent(c.Clock(), c.Cmd, c.getEventCmd(-1), c.StartTime, reason))
+	}
+	c.Lock.Unlock()
+	err := c.stop(forwardedSignal)
 	finishTime := c.Clock()
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
 	if err != nil {
 		err = fmt.Errorf("command had error on kill: %v: %v", c.Cmd, err)
+	} else if reason != nil {
+		err = fmt.Errorf("command killed: %v: %v", c.Cmd, reason)
+	}
+	c.finish(finishTime, -1, true, err)
+}
+
+// Skip marks the command as finished without ever starting it,
+// if it has not already been started.
+func (c *cmdController) Skip(reason error) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	if c.Started || c.Finished {
+		return
+	}
+	c.Started = true
+	c.Finished = true
+	c.Result.Skipped = true
+	close(c.DoneC)
+	c.EventHandler(newCmdSkippedEvent(c.Clock(), c.Cmd, c.getEventCmd(-1), reason))
+}
+
+// Succeeded returns true if the command ran and finished
+// successfully on its own.
+func (c *cmdController) Succeeded() bool {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.Result.Started && !c.Result.Killed && c.Result.Err == nil
+}
+
+// GetResult returns a copy of the result of the command.
+func (c *cmdController) GetResult() *CmdResult {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	result := c.Result
+	return &result
+}
+
+// timeOut stops the command because it exceeded its timeout. The
+// command is finished by Run once Wait returns.
+func (c *cmdController) timeOut() {
+	c.Lock.Lock()
+	if c.Finished || c.Stopping || c.TimedOut {
+		c.Lock.Unlock()
+		return
+	}
+	c.TimedOut = true
+	c.EventHandler(newCmdTimedOutEvent(
+		c.Clock(),
+		c.Cmd,
+		c.getEventCmd(-1),
+		c.StartTime,
+		fmt.Errorf("command exceeded timeout of %v", c.Config.Timeout),
+	))
+	c.Lock.Unlock()
+	// if the stop fails, Run will still report the timeout once
+	// the command finishes
+	_ = c.stop(nil)
+}
+
+// stop stops the running command, first by sending the stop signal
+// and waiting up to the stop grace period if configured, and then by
+// killing it. If forwardedSignal is not nil, it is sent instead of
+// the stop signal with the forward grace period. Must be called
+// without the lock held.
+func (c *cmdController) stop(forwardedSignal os.Signal) error {
+	c.Cancel()
+	c.Lock.Lock()
+	running, waitC := c.Running, c.WaitC
+	c.Lock.Unlock()
+	if !running {
+		return nil
+	}
+	stopSignal, gracePeriod := c.Config.StopSignal, c.Config.StopGracePeriod
+	if forwardedSignal != nil {
+		stopSignal, gracePeriod = forwardedSignal, c.Config.ForwardGracePeriod
+	}
+	if stopSignal != nil {
+		c.setStoppedBy(stopStageSignal)
+		if err := c.signal(stopSignal); err == nil {
+			timer := time.NewTimer(gracePeriod)
+			defer timer.Stop()
+			select {
+			case <-waitC:
+				return nil
+			case <-timer.C:
+			}
+		}
+	}
+	c.setStoppedBy(stopStageKill)
+	if err := c.Cmd.Kill(); err != nil {
+		select {
+		case <-waitC:
+			// the command exited before it could be killed
+			return nil
+		default:
+			return err
+		}
+	}
+	// give Wait a moment to return so that the remaining output of
+	// the command is written before the command is finished, this
+	// may not happen if descendants of the command hold its output
+	timer := time.NewTimer(killWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-waitC:
+	case <-timer.C:
+	}
+	return nil
+}
+
+// GetPgids returns the process groups the command was started in.
+func (c *cmdController) GetPgids() []int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.Pgids
+}
+
+func (c *cmdController) setStoppedBy(stoppedBy string) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.StoppedBy = stoppedBy
+}
+
+func (c *cmdController) signal(sig os.Signal) error {
+	if signalCmd, ok := c.Cmd.(SignalCmd); ok {
+		return signalCmd.Signal(sig)
+	}
+	return errSignalNotSupported
+}
+
+func (c *cmdController) start(ctx context.Context) error {
+	if contextCmd, ok := c.Cmd.(ContextCmd); ok {
+		return contextCmd.StartContext(ctx)
+	}
+	return c.Cmd.Start()
+}
+
+// finish must be called with the lock held.
+func (c *cmdController) finish(finishTime time.Time, exitCode int, killed bool, err error) {
+	c.Finished = true
+	c.Result.Started = true
+	c.Result.Killed = killed
+	c.Result.TimedOut = c.TimedOut
+	c.Result.StoppedBy = c.StoppedBy
+	c.Result.Attempts = c.Attempt
+	c.Result.ExitCode = exitCode
+	c.Result.Duration = finishTime.Sub(c.StartTime)
+	c.Result.Err = err
+	c.Result.LimitExceeded = c.LimitExceeded
+	close(c.DoneC)
+	if _, ok := c.Cmd.(OutputCmd); ok && c.Config.Output != nil {
+		result := c.Result
+		c.Config.Output.Finish(c.Config.Index, &result)
+	}
+	c.sendStartedEvent()
+	eventCmd := c.getEventCmd(exitCode)
+	eventCmd.ResourceUsage = c.Result.ResourceUsage
+	c.EventHandler(newCmdFinishedEvent(finishTime, c.Cmd, eventCmd, c.StartTime, c.StoppedBy, c.Attempt, err))
+}
+
+// addResourceUsage adds the resources used by the last attempt to
+// the result, unless the command is already finished. Must be called
+// with the lock held.
+func (c *cmdController) addResourceUsage() {
+	resourceUsageCmd, ok := c.Cmd.(ResourceUsageCmd)
+	if !ok || c.Finished {
+		return
+	}
+	resourceUsage := resourceUsageCmd.ResourceUsage()
+	if resourceUsage == nil {
+		return
+	}
+	if c.Result.ResourceUsage == nil {
+		c.Result.ResourceUsage = &ResourceUsage{}
+	}
+	c.Result.ResourceUsage.add(resourceUsage)
+}
+
+// sendStartedEvent sends the cmd_started Event if it was not sent
+// already. Must be called with the lock held.
+func (c *cmdController) sendStartedEvent() {
+	if c.StartedSent {
+		return
+	}
+	c.StartedSent = true
+	c.EventHandler(newCmdStartedEvent(c.StartTime, c.Cmd, c.getEventCmd(-1)))
+}
+
+// getEventCmd returns the EventCmd for the command, with the exit
+// code if it is not negative. Must be called with the lock held.
+func (c *cmdController) getEventCmd(exitCode int) *EventCmd {
+	eventCmd := &EventCmd{
+		Index:         c.Config.Index,
+		ID:            c.Config.ID,
+		Name:          getCmdName(c.Config.Name, c.Cmd),
+		Signal:        c.Signal,
+		LimitExceeded: c.LimitExceeded,
+	}
+	if pidCmd, ok := c.Cmd.(pidCmd); ok {
+		eventCmd.PID = pidCmd.Pid()
+	}
+	if exitCode >= 0 {
+		eventCmd.ExitCode = &exitCode
+	}
+	return eventCmd
+}
+
+func getExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
 	}
-	c.EventHandler(newCmdFinishedEvent(finishTime, c.Cmd, c.StartTime, err))
+	return -1
 }
@@ -0,0 +1,149 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DurationHistory is a history of the durations of commands, keyed by
+// the command string, that can be persisted to a file and used with
+// LongestFirst.
+//
+// To keep the history up to date, call HandleEvent from the
+// Runner's event handler.
+type DurationHistory struct {
+	durations map[string]time.Duration
+	lock      sync.RWMutex
+}
+
+// NewDurationHistory returns a new empty DurationHistory.
+func NewDurationHistory() *DurationHistory {
+	return &DurationHistory{durations: make(map[string]time.Duration)}
+}
+
+// ReadDurationHistory reads a DurationHistory from the file written by
+// WriteFile, or returns an empty DurationHistory if the file does not
+// exist.
+func ReadDurationHistory(filePath string) (*DurationHistory, error) {
+	durationHistory := NewDurationHistory()
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return durationHistory, nil
+		}
+		return nil, err
+	}
+	durationStrings := make(map[string]string)
+	if err := json.Unmarshal(data, &durationStrings); err != nil {
+		return nil, err
+	}
+	for cmd, durationString := range durationStrings {
+		duration, err := time.ParseDuration(durationString)
+		if err != nil {
+			return nil, err
+		}
+		durationHistory.durations[cmd] = duration
+	}
+	return durationHistory, nil
+}
+
+// Duration returns the expected duration of the command, and false
+// if the command is not in the history.
+func (h *DurationHistory) Duration(cmd string) (time.Duration, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	duration, ok := h.durations[cmd]
+	return duration, ok
+}
+
+// Record records a duration of the command.
+//
+// The expected duration is the average of the recorded duration and
+// the previous expected duration, so that older runs matter less.
+func (h *DurationHistory) Record(cmd string, duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if previous, ok := h.durations[cmd]; ok {
+		duration = (previous + duration) / 2
+	}
+	h.durations[cmd] = duration
+}
+
+// HandleEvent records the duration of successful cmd_finished Events,
+// and ignores all other Events. Commands that were stopped by the
+// Runner are ignored as well, as their duration is not how long they
+// take to run.
+func (h *DurationHistory) HandleEvent(event *Event) {
+	if event.Type != EventTypeCmdFinished || event.Error != "" {
+		return
+	}
+	if _, ok := event.Fields["stopped_by"]; ok {
+		return
+	}
+	cmd, ok := event.Fields["cmd"].(string)
+	if !ok {
+		return
+	}
+	durationString, ok := event.Fields["duration"].(string)
+	if !ok {
+		return
+	}
+	duration, err := time.ParseDuration(durationString)
+	if err != nil {
+		return
+	}
+	h.Record(cmd, duration)
+}
+
+// WriteFile writes the DurationHistory to the file, replacing it
+// atomically if it exists.
+func (h *DurationHistory) WriteFile(filePath string) error {
+	h.lock.RLock()
+	durationStrings := make(map[string]string, len(h.durations))
+	for cmd, duration := range h.durations {
+		durationStrings[cmd] = duration.String()
+	}
+	h.lock.RUnlock()
+	data, err := json.MarshalIndent(durationStrings, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationHistory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "parallel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	filePath := filepath.Join(tmpDir, "durations.json")
+
+	durationHistory, err := ReadDurationHistory(filePath)
+	require.NoError(t, err)
+	_, ok := durationHistory.Duration("a")
+	require.False(t, ok)
+
+	cmd := ExecCmd(newSimpleCmd(0, "1", 0))
+	startTime := time.Unix(0, 0)
+	durationHistory.HandleEvent(newCmdFinishedEvent(startTime.Add(2*time.Second), cmd, nil, startTime, "", 1, nil))
+	durationHistory.HandleEvent(newCmdFinishedEvent(startTime.Add(time.Minute), cmd, nil, startTime, "", 1, errors.New("failed")))
+	durationHistory.HandleEvent(newCmdStartedEvent(startTime, cmd, nil))
+	durationHistory.HandleEvent(newCmdFinishedEvent(startTime.Add(time.Second), cmd, nil, startTime, stopStageKill, 1, nil))
+	duration, ok := durationHistory.Duration(cmd.String())
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, duration)
+	durationHistory.Record(cmd.String(), 4*time.Second)
+	duration, _ = durationHistory.Duration(cmd.String())
+	assert.Equal(t, 3*time.Second, duration)
+
+	require.NoError(t, durationHistory.WriteFile(filePath))
+	durationHistory, err = ReadDurationHistory(filePath)
+	require.NoError(t, err)
+	duration, ok = durationHistory.Duration(cmd.String())
+	require.True(t, ok)
+	assert.Equal(t, 3*time.Second, duration)
+}
+
+func TestDurationHistoryFastFail(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "parallel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	durationHistory, err := ReadDurationHistory(filepath.Join(tmpDir, "durations.json"))
+	require.NoError(t, err)
+
+	cmds := []*exec.Cmd{
+		newSimpleCmd(5, "1", 0),
+		newSimpleCmd(0, "2", 1),
+	}
+	testEnv := newTestEnv(2, cmds, WithFastFail())
+	err = testEnv.run()
+	require.Error(t, err)
+	// the slow command is killed by fast fail without an error
+	event := testEnv.eventHandler.OneEventForTypeSuccess(t, EventTypeCmdFinished)
+	require.Equal(t, stopStageKill, event.Fields["stopped_by"])
+	for _, event := range testEnv.eventHandler.events {
+		durationHistory.HandleEvent(event)
+	}
+	_, ok := durationHistory.Duration(ExecCmd(cmds[0]).String())
+	require.False(t, ok)
+}
@@ -27,28 +27,110 @@ func newEvent(e EventType, t time.Time, f map[string]interface{}, err error) *Ev
 	if err != nil {
 		errString = err.Error()
 	}
-	return &Event{e, t, f, errString}
+	return &Event{Type: e, Time: t, Fields: f, Error: errString}
 }
 
 func newStartedEvent(t time.Time) *Event {
 	return newEvent(EventTypeStarted, t, nil, nil)
 }
 
-func newCmdStartedEvent(t time.Time, cmd Cmd) *Event {
-	return newEvent(EventTypeCmdStarted, t, map[string]interface{}{
+func newCmdStartedEvent(t time.Time, cmd Cmd, eventCmd *EventCmd) *Event {
+	event := newEvent(EventTypeCmdStarted, t, map[string]interface{}{
 		"cmd": cmd.String(),
 	}, nil)
+	event.Cmd = eventCmd
+	return event
 }
 
-func newCmdFinishedEvent(t time.Time, cmd Cmd, startTime time.Time, err error) *Event {
-	return newEvent(EventTypeCmdFinished, t, map[string]interface{}{
+func newCmdFinishedEvent(t time.Time, cmd Cmd, eventCmd *EventCmd, startTime time.Time, stoppedBy string, attempts int, err error) *Event {
+	fields := map[string]interface{}{
 		"cmd":      cmd.String(),
 		"duration": t.Sub(startTime).String(),
+	}
+	if stoppedBy != "" {
+		fields["stopped_by"] = stoppedBy
+	}
+	if attempts > 1 {
+		fields["attempts"] = attempts
+	}
+	if eventCmd != nil && eventCmd.LimitExceeded != "" {
+		fields["limit_exceeded"] = eventCmd.LimitExceeded
+	}
+	event := newEvent(EventTypeCmdFinished, t, fields, err)
+	event.Cmd = eventCmd
+	event.Duration = t.Sub(startTime)
+	event.Attempt = attempts
+	return event
+}
+
+func newCmdRetriedEvent(t time.Time, cmd Cmd, eventCmd *EventCmd, attempt int, backoff time.Duration, err error) *Event {
+	event := newEvent(EventTypeCmdRetried, t, map[string]interface{}{
+		"cmd":     cmd.String(),
+		"attempt": attempt,
+		"backoff": backoff.String(),
 	}, err)
+	event.Cmd = eventCmd
+	event.Attempt = attempt
+	return event
 }
 
-func newFinishedEvent(t time.Time, startTime time.Time, err error) *Event {
-	return newEvent(EventTypeFinished, t, map[string]interface{}{
+func newCmdTimedOutEvent(t time.Time, cmd Cmd, eventCmd *EventCmd, startTime time.Time, err error) *Event {
+	event := newEvent(EventTypeCmdTimedOut, t, map[string]interface{}{
+		"cmd":      cmd.String(),
 		"duration": t.Sub(startTime).String(),
 	}, err)
+	event.Cmd = eventCmd
+	event.Duration = t.Sub(startTime)
+	return event
+}
+
+func newCmdSkippedEvent(t time.Time, cmd Cmd, eventCmd *EventCmd, reason error) *Event {
+	event := newEvent(EventTypeCmdSkipped, t, map[string]interface{}{
+		"cmd":    cmd.String(),
+		"reason": reason.Error(),
+	}, nil)
+	event.Cmd = eventCmd
+	return event
+}
+
+func newCmdKilledEvent(t time.Time, cmd Cmd, eventCmd *EventCmd, reason error) *Event {
+	event := newEvent(EventTypeCmdKilled, t, map[string]interface{}{
+		"cmd":    cmd.String(),
+		"reason": reason.Error(),
+	}, nil)
+	event.Cmd = eventCmd
+	return event
+}
+
+func newOrphanReapedEvent(t time.Time, childProcess *childProcess, status string, err error) *Event {
+	fields := map[string]interface{}{
+		"pid": childProcess.Pid,
+		"cmd": childProcess.Cmd,
+	}
+	if status != "" {
+		fields["status"] = status
+	}
+	return newEvent(EventTypeOrphanReaped, t, fields, err)
+}
+
+func newConcurrencyChangedEvent(t time.Time, previousLimit int, limit int, load *systemLoad) *Event {
+	return newEvent(EventTypeConcurrencyChanged, t, map[string]interface{}{
+		"max_concurrent_cmds":          limit,
+		"previous_max_concurrent_cmds": previousLimit,
+		"load_per_cpu":                 load.LoadPerCPU,
+		"cpu_pressure":                 load.CPUPressure,
+		"memory_pressure":              load.MemoryPressure,
+	}, nil)
+}
+
+func newFinishedEvent(t time.Time, startTime time.Time, stopReason string, err error) *Event {
+	fields := map[string]interface{}{
+		"duration": t.Sub(startTime).String(),
+	}
+	if stopReason != "" {
+		fields["stop_reason"] = stopReason
+	}
+	event := newEvent(EventTypeFinished, t, fields, err)
+	event.Duration = t.Sub(startTime)
+	return event
 }
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventJSON(t *testing.T) {
+	exitCode := 1
+	startTime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := newCmdFinishedEvent(
+		startTime.Add(1500*time.Millisecond),
+		newTestNopCmd("foo", nil, nil),
+		&EventCmd{Index: 0, ID: "0", Name: "foo", PID: 10, ExitCode: &exitCode},
+		startTime,
+		"",
+		2,
+		errors.New("failed"),
+	)
+	event.RunID = "abc"
+	data, err := json.Marshal(event)
+	require.NoError(t, err)
+	// the fields are the same as before the typed fields were added
+	require.JSONEq(t, `{
+		"type": "cmd_finished",
+		"time": "2019-01-01T00:00:01.5Z",
+		"run_id": "abc",
+		"cmd": {"index": 0, "id": "0", "name": "foo", "pid": 10, "exit_code": 1},
+		"duration_ns": 1500000000,
+		"attempt": 2,
+		"fields": {"cmd": "foo", "duration": "1.5s", "attempts": 2},
+		"error": "failed"
+	}`, string(data))
+
+	var unmarshalled Event
+	require.NoError(t, json.Unmarshal(data, &unmarshalled))
+	assert.Equal(t, "abc", unmarshalled.RunID)
+	assert.Equal(t, event.Cmd, unmarshalled.Cmd)
+	assert.Equal(t, 1500*time.Millisecond, unmarshalled.Duration)
+	assert.Equal(t, 2, unmarshalled.Attempt)
+}
+
+func TestEventFields(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 3),
+		newSimpleCmd(5, "3", 0),
+	}
+	testEnv := newTestEnv(3, cmds, WithCmdTimeout(200*time.Millisecond))
+	testEnv.execCmdOptions = []ExecCmdOption{WithProcessGroup()}
+	err := testEnv.run()
+	require.Error(t, err)
+
+	runID := testEnv.eventHandler.StartedEvent(t).RunID
+	require.NotEmpty(t, runID)
+	require.Equal(t, runID, testEnv.eventHandler.FinishedEvent(t).RunID)
+	startedEvents := testEnv.eventHandler.NumEventsForType(t, EventTypeCmdStarted, 3)
+	finishedEvents := testEnv.eventHandler.NumEventsForType(t, EventTypeCmdFinished, 3)
+	eventCmds := make(map[int]*EventCmd)
+	for _, event := range finishedEvents {
+		require.Equal(t, runID, event.RunID)
+		require.NotNil(t, event.Cmd)
+		require.True(t, event.Duration > 0)
+		require.Equal(t, 1, event.Attempt)
+		eventCmds[event.Cmd.Index] = event.Cmd
+	}
+	for _, event := range startedEvents {
+		require.Equal(t, eventCmds[event.Cmd.Index].PID, event.Cmd.PID)
+	}
+	require.Len(t, eventCmds, 3)
+	for index, eventCmd := range eventCmds {
+		require.Equal(t, ExecCmd(cmds[index]).String(), eventCmd.Name)
+		require.True(t, eventCmd.PID > 0)
+	}
+	require.NotNil(t, eventCmds[0].ResourceUsage)
+	require.True(t, eventCmds[0].ResourceUsage.MaxRSS > 0)
+	require.Equal(t, eventCmds[0].ResourceUsage, err.(*RunError).Results[0].ResourceUsage)
+	require.Equal(t, "0", eventCmds[0].ID)
+	require.Equal(t, 0, *eventCmds[0].ExitCode)
+	require.Equal(t, 3, *eventCmds[1].ExitCode)
+	require.Nil(t, eventCmds[2].ExitCode)
+	require.Equal(t, "killed", eventCmds[2].Signal)
+}
@@ -35,6 +35,25 @@ const (
 	EventTypeCmdFinished
 	// EventTypeFinished says that the runner finished.
 	EventTypeFinished
+	// EventTypeCmdSkipped says that a command was skipped.
+	EventTypeCmdSkipped
+	// EventTypeCmdTimedOut says that a command timed out.
+	EventTypeCmdTimedOut
+	// EventTypeOrphanReaped says that an orphaned descendant
+	// of a command was reaped.
+	EventTypeOrphanReaped
+	// EventTypeCmdRetried says that a command failed and will be retried.
+	EventTypeCmdRetried
+	// EventTypeStageStarted says that a stage of commands started.
+	EventTypeStageStarted
+	// EventTypeStageFinished says that a stage of commands finished.
+	EventTypeStageFinished
+	// EventTypeConcurrencyChanged says that the maximum number of
+	// concurrent commands was changed because of the system load.
+	EventTypeConcurrencyChanged
+	// EventTypeCmdKilled says that a command was killed before it
+	// started because the run stopped.
+	EventTypeCmdKilled
 )
 
 var allEventTypes = []EventType{
@@ -42,6 +61,14 @@ var allEventTypes = []EventType{
 	EventTypeCmdStarted,
 	EventTypeCmdFinished,
 	EventTypeFinished,
+	EventTypeCmdSkipped,
+	EventTypeCmdTimedOut,
+	EventTypeOrphanReaped,
+	EventTypeCmdRetried,
+	EventTypeStageStarted,
+	EventTypeStageFinished,
+	EventTypeConcurrencyChanged,
+	EventTypeCmdKilled,
 }
 
 // EventType is an event type during the runner's run call.
@@ -58,6 +85,22 @@ func (e EventType) String() string {
 		return "cmd_finished"
 	case EventTypeFinished:
 		return "finished"
+	case EventTypeCmdSkipped:
+		return "cmd_skipped"
+	case EventTypeCmdTimedOut:
+		return "cmd_timed_out"
+	case EventTypeOrphanReaped:
+		return "orphan_reaped"
+	case EventTypeCmdRetried:
+		return "cmd_retried"
+	case EventTypeStageStarted:
+		return "stage_started"
+	case EventTypeStageFinished:
+		return "stage_finished"
+	case EventTypeConcurrencyChanged:
+		return "concurrency_changed"
+	case EventTypeCmdKilled:
+		return "cmd_killed"
 	default:
 		return strconv.Itoa(int(e))
 	}
@@ -80,6 +123,22 @@ func (e *EventType) UnmarshalJSON(data []byte) error {
 		*e = EventTypeCmdFinished
 	case `"finished"`:
 		*e = EventTypeFinished
+	case `"cmd_skipped"`:
+		*e = EventTypeCmdSkipped
+	case `"cmd_timed_out"`:
+		*e = EventTypeCmdTimedOut
+	case `"orphan_reaped"`:
+		*e = EventTypeOrphanReaped
+	case `"cmd_retried"`:
+		*e = EventTypeCmdRetried
+	case `"stage_started"`:
+		*e = EventTypeStageStarted
+	case `"stage_finished"`:
+		*e = EventTypeStageFinished
+	case `"concurrency_changed"`:
+		*e = EventTypeConcurrencyChanged
+	case `"cmd_killed"`:
+		*e = EventTypeCmdKilled
 	default:
 		return invalidEventType(data, "json")
 	}
@@ -103,6 +162,22 @@ func (e *EventType) UnmarshalText(data []byte) error {
 		*e = EventTypeCmdFinished
 	case "finished":
 		*e = EventTypeFinished
+	case "cmd_skipped":
+		*e = EventTypeCmdSkipped
+	case "cmd_timed_out":
+		*e = EventTypeCmdTimedOut
+	case "orphan_reaped":
+		*e = EventTypeOrphanReaped
+	case "cmd_retried":
+		*e = EventTypeCmdRetried
+	case "stage_started":
+		*e = EventTypeStageStarted
+	case "stage_finished":
+		*e = EventTypeStageFinished
+	case "concurrency_changed":
+		*e = EventTypeConcurrencyChanged
+	case "cmd_killed":
+		*e = EventTypeCmdKilled
 	default:
 		return invalidEventType(data, "text")
 	}
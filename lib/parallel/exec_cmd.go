@@ -21,25 +21,143 @@
 package parallel
 
 import (
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 )
 
 type execCmd struct {
 	*exec.Cmd
+	ProcessGroup bool
+	Limits       *Limits
+	// Cgroup is the cgroup of the last run of the command,
+	// or empty if it has none.
+	Cgroup string
+	// ExceededLimit is the limit the last run of the command
+	// was killed for exceeding, if any.
+	ExceededLimit string
 }
 
-func newExecCmd(cmd *exec.Cmd) *execCmd {
-	return &execCmd{cmd}
+func newExecCmd(cmd *exec.Cmd, options ...ExecCmdOption) *execCmd {
+	execCmd := &execCmd{cmd, false, nil, "", ""}
+	for _, option := range options {
+		option(execCmd)
+	}
+	return execCmd
+}
+
+func (e *execCmd) Start() error {
+	if e.ProcessGroup {
+		setProcessGroup(e.Cmd)
+	}
+	if e.Limits != nil {
+		return e.startWithLimits()
+	}
+	return e.Cmd.Start()
+}
+
+func (e *execCmd) Wait() error {
+	err := e.Cmd.Wait()
+	if e.Limits != nil {
+		e.ExceededLimit = e.finishWithLimits(err)
+	}
+	return err
 }
 
 func (e *execCmd) Kill() error {
-	if e.Process != nil {
-		return e.Process.Kill()
+	if e.Process == nil {
+		return nil
+	}
+	if e.Cgroup != "" {
+		// this also kills descendants that left the process group
+		_ = killCgroup(e.Cgroup)
 	}
+	if e.ProcessGroup {
+		return killProcessGroup(e.Process.Pid)
+	}
+	return e.Process.Kill()
+}
+
+func (e *execCmd) Signal(sig os.Signal) error {
+	if e.Process == nil {
+		return nil
+	}
+	if e.ProcessGroup {
+		return signalProcessGroup(e.Process.Pid, sig)
+	}
+	return e.Process.Signal(sig)
+}
+
+func (e *execCmd) SetOutput(stdout io.Writer, stderr io.Writer) {
+	e.Stdout = stdout
+	e.Stderr = stderr
+}
+
+// Reset replaces the exec.Cmd with a copy that has not been started.
+//
+// Stdin is reused as is, so commands that read from Stdin may not
+// see the same input when started again.
+func (e *execCmd) Reset() error {
+	e.Cmd = &exec.Cmd{
+		Path:        e.Path,
+		Args:        e.Args,
+		Env:         e.Env,
+		Dir:         e.Dir,
+		Stdin:       e.Stdin,
+		Stdout:      e.Stdout,
+		Stderr:      e.Stderr,
+		ExtraFiles:  e.ExtraFiles,
+		SysProcAttr: e.SysProcAttr,
+	}
+	e.Cgroup = ""
+	e.ExceededLimit = ""
 	return nil
 }
 
+// Pgid returns the process group of the command if it runs in its
+// own process group, or 0 otherwise.
+func (e *execCmd) Pgid() int {
+	if !e.ProcessGroup {
+		return 0
+	}
+	return e.Pid()
+}
+
+// Pid returns the process ID of the command, or 0 if it
+// has not been started.
+func (e *execCmd) Pid() int {
+	if e.Process == nil {
+		return 0
+	}
+	return e.Process.Pid
+}
+
+// ResourceUsage returns the resources used by the command, or nil
+// if it has not exited.
+func (e *execCmd) ResourceUsage() *ResourceUsage {
+	if e.ProcessState == nil {
+		return nil
+	}
+	resourceUsage := &ResourceUsage{
+		UserTime:   e.ProcessState.UserTime(),
+		SystemTime: e.ProcessState.SystemTime(),
+	}
+	setSysResourceUsage(resourceUsage, e.ProcessState)
+	return resourceUsage
+}
+
+// LimitExceeded returns the limit the last run of the command
+// was killed for exceeding, if any.
+func (e *execCmd) LimitExceeded() string {
+	return e.ExceededLimit
+}
+
 func (e *execCmd) String() string {
-	return strings.Join(append([]string{e.Path}, e.Args...), " ")
+	// Args includes the command name, unless the Cmd was
+	// not created by exec.Command
+	if len(e.Args) == 0 {
+		return e.Path
+	}
+	return strings.Join(e.Args, " ")
 }
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package parallel
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(pid int) error {
+	return signalProcessGroup(pid, syscall.SIGKILL)
+}
+
+func signalProcessGroup(pid int, sig os.Signal) error {
+	syscallSignal, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", sig)
+	}
+	// the process group ID is the pid of the leader, and
+	// a negative pid signals the whole group
+	if err := syscall.Kill(-pid, syscallSignal); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// getSignal returns the description of the signal that terminated
+// the command, if err is from Wait and the command was terminated
+// by a signal.
+func getSignal(err error) string {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return ""
+	}
+	waitStatus, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !waitStatus.Signaled() {
+		return ""
+	}
+	return waitStatus.Signal().String()
+}
+
+// setSysResourceUsage sets the fields of resourceUsage that are
+// only available from the rusage of the process.
+func setSysResourceUsage(resourceUsage *ResourceUsage, processState *os.ProcessState) {
+	rusage, ok := processState.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return
+	}
+	// ru_maxrss is in bytes on Darwin and in kilobytes elsewhere
+	resourceUsage.MaxRSS = int64(rusage.Maxrss)
+	if runtime.GOOS != "darwin" {
+		resourceUsage.MaxRSS *= 1024
+	}
+	resourceUsage.VoluntaryContextSwitches = int64(rusage.Nvcsw)
+	resourceUsage.InvoluntaryContextSwitches = int64(rusage.Nivcsw)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errFailureThresholdEmpty = errors.New("failure threshold needs failures or percent")
+
+// FailureThreshold stops a run once enough of its commands failed,
+// between stopping on the first failure with fast fail and running
+// all the commands.
+//
+// Commands that are skipped because a dependency did not succeed are
+// not counted as failed.
+type FailureThreshold struct {
+	// Failures stops the run once this many commands failed,
+	// or never if 0.
+	Failures int
+	// Percent stops the run once more than this percentage of the
+	// commands of the run failed, or never if 0.
+	Percent float64
+}
+
+func validateFailureThreshold(failureThreshold *FailureThreshold) error {
+	if failureThreshold.Failures < 0 {
+		return fmt.Errorf("failure threshold failures is negative: %d", failureThreshold.Failures)
+	}
+	if failureThreshold.Percent < 0 || failureThreshold.Percent > 100 {
+		return fmt.Errorf("failure threshold percent must be between 0 and 100: %v", failureThreshold.Percent)
+	}
+	if failureThreshold.Failures == 0 && failureThreshold.Percent == 0 {
+		return errFailureThresholdEmpty
+	}
+	return nil
+}
+
+// isReached returns true if numFailed of numCmds commands failing
+// reaches the threshold.
+func (t *FailureThreshold) isReached(numFailed int, numCmds int) bool {
+	if t.Failures > 0 && numFailed >= t.Failures {
+		return true
+	}
+	return t.Percent > 0 && float64(numFailed)*100 > t.Percent*float64(numCmds)
+}
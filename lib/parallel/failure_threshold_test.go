@@ -0,0 +1,43 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureThresholdIsReached(t *testing.T) {
+	failureThreshold := &FailureThreshold{Failures: 5, Percent: 10}
+	assert.False(t, failureThreshold.isReached(1, 10))
+	assert.True(t, failureThreshold.isReached(2, 10))
+	assert.False(t, failureThreshold.isReached(4, 100))
+	assert.True(t, failureThreshold.isReached(5, 100))
+}
+
+func TestFailureThresholdInvalid(t *testing.T) {
+	runner := newRunner(WithFailureThreshold(FailureThreshold{}))
+	require.EqualError(t, runner.Run(nil), "failure threshold needs failures or percent")
+	runner = newRunner(WithFailureThreshold(FailureThreshold{Percent: 150}))
+	require.EqualError(t, runner.Run(nil), "failure threshold percent must be between 0 and 100: 150")
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	errFuncCmdStarted    = errors.New("function command already started")
+	errFuncCmdNotStarted = errors.New("function command not started")
+)
+
+type funcCmd struct {
+	Name   string
+	Func   func(context.Context) error
+	Cancel context.CancelFunc
+	// DoneC is closed once Func returns, or is nil if the
+	// command has not been started.
+	DoneC chan struct{}
+	Err   error
+	Lock  sync.Mutex
+}
+
+func newFuncCmd(name string, f func(context.Context) error) *funcCmd {
+	return &funcCmd{Name: name, Func: f}
+}
+
+func (f *funcCmd) Start() error {
+	return f.StartContext(context.Background())
+}
+
+// StartContext calls Func on a new goroutine with a context that is
+// cancelled when ctx is done or the command is killed.
+func (f *funcCmd) StartContext(ctx context.Context) error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if f.DoneC != nil {
+		return errFuncCmdStarted
+	}
+	ctx, f.Cancel = context.WithCancel(ctx)
+	doneC := make(chan struct{})
+	f.DoneC = doneC
+	go func() {
+		err := f.call(ctx)
+		f.Lock.Lock()
+		f.Err = err
+		f.Lock.Unlock()
+		close(doneC)
+	}()
+	return nil
+}
+
+func (f *funcCmd) Wait() error {
+	f.Lock.Lock()
+	doneC := f.DoneC
+	f.Lock.Unlock()
+	if doneC == nil {
+		return errFuncCmdNotStarted
+	}
+	<-doneC
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	f.Cancel()
+	return f.Err
+}
+
+// Kill cancels the context given to Func. Func is responsible for
+// returning once its context is done.
+func (f *funcCmd) Kill() error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if f.Cancel != nil {
+		f.Cancel()
+	}
+	return nil
+}
+
+// Reset allows the command to be started again once Func returned.
+func (f *funcCmd) Reset() error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if f.DoneC != nil {
+		select {
+		case <-f.DoneC:
+		default:
+			return errFuncCmdStarted
+		}
+	}
+	f.Cancel = nil
+	f.DoneC = nil
+	f.Err = nil
+	return nil
+}
+
+func (f *funcCmd) String() string {
+	return f.Name
+}
+
+// call calls Func, and returns a panic in Func as an error.
+func (f *funcCmd) call(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return f.Func(ctx)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncCmd(t *testing.T) {
+	testEnv := newTestEnv(2, []*exec.Cmd{newSimpleCmd(0, "1", 0)})
+	var called bool
+	require.NoError(t, testEnv.runner.Run([]Cmd{
+		ExecCmd(testEnv.cmds[0]),
+		FuncCmd("func", func(ctx context.Context) error {
+			called = true
+			return nil
+		}),
+	}))
+	require.True(t, called)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 2)
+	require.Equal(t, []string{"1"}, testEnv.stdout.Lines(t))
+}
+
+func TestFuncCmdError(t *testing.T) {
+	testEnv := newTestEnv(2, nil)
+	err := testEnv.runner.Run([]Cmd{
+		FuncCmd("error", func(ctx context.Context) error {
+			return errors.New("failed")
+		}),
+		FuncCmd("panic", func(ctx context.Context) error {
+			panic("oops")
+		}),
+	})
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.Len(t, results, 2)
+	assert.Contains(t, results[0].Err.Error(), "failed")
+	assert.Contains(t, results[1].Err.Error(), "panic: oops")
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+}
+
+func TestFuncCmdKill(t *testing.T) {
+	testEnv := newTestEnv(1, nil, WithCmdTimeout(100*time.Millisecond))
+	err := testEnv.runner.Run([]Cmd{
+		FuncCmd("block", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	})
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	require.Len(t, err.(*RunError).TimedOut(), 1)
+	testEnv.eventHandler.OneEventForTypeError(t, EventTypeCmdTimedOut)
+}
+
+func TestFuncCmdRetry(t *testing.T) {
+	testEnv := newTestEnv(1, nil, WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	var attempts int
+	require.NoError(t, testEnv.runner.Run([]Cmd{
+		FuncCmd("flaky", func(ctx context.Context) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("flaky")
+			}
+			return nil
+		}),
+	}))
+	require.Equal(t, 3, attempts)
+	testEnv.eventHandler.NumEventsForType(t, EventTypeCmdRetried, 2)
+}
+
+func TestFuncCmdStartTwice(t *testing.T) {
+	cmd := FuncCmd("nop", func(ctx context.Context) error { return nil }).(RetryableCmd)
+	require.Equal(t, errFuncCmdNotStarted, cmd.Wait())
+	require.NoError(t, cmd.Start())
+	require.Equal(t, errFuncCmdStarted, cmd.Start())
+	require.NoError(t, cmd.Wait())
+	require.NoError(t, cmd.Reset())
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Wait())
+}
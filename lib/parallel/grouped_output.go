@@ -0,0 +1,187 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultMaxBufferSize is the default maximum number of bytes of
+// output of a command that a grouped Output buffers in memory.
+const DefaultMaxBufferSize = 1024 * 1024
+
+// GroupedOutputOption is an option for a new grouped Output.
+type GroupedOutputOption func(*groupedOutput)
+
+// WithMaxBufferSize returns a GroupedOutputOption that will make the
+// Output buffer at most maxBufferSize bytes of output of a command in
+// memory before spilling to a temporary file.
+func WithMaxBufferSize(maxBufferSize int) GroupedOutputOption {
+	return func(groupedOutput *groupedOutput) {
+		groupedOutput.MaxBufferSize = maxBufferSize
+	}
+}
+
+// NewGroupedOutput returns a new Output that buffers the standard
+// output and standard error of each command, and writes them to
+// writer as one contiguous block once the command finishes, headed
+// by the name of the command and how the command finished.
+//
+// Output of commands that are killed is written when they are killed.
+// Output above the maximum buffer size is spilled to a temporary file.
+func NewGroupedOutput(writer io.Writer, options ...GroupedOutputOption) Output {
+	return newGroupedOutput(writer, options...)
+}
+
+type groupedOutput struct {
+	Writer        io.Writer
+	MaxBufferSize int
+	CmdOutputs    map[int]*groupedCmdOutput
+	// Lock guards CmdOutputs, and writes to Writer
+	Lock sync.Mutex
+}
+
+func newGroupedOutput(writer io.Writer, options ...GroupedOutputOption) *groupedOutput {
+	groupedOutput := &groupedOutput{
+		writer,
+		DefaultMaxBufferSize,
+		make(map[int]*groupedCmdOutput),
+		sync.Mutex{},
+	}
+	for _, option := range options {
+		option(groupedOutput)
+	}
+	return groupedOutput
+}
+
+func (o *groupedOutput) Start(info CmdInfo) (io.Writer, io.Writer) {
+	cmdOutput := newGroupedCmdOutput(o.MaxBufferSize)
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.CmdOutputs[info.Index] = cmdOutput
+	// the same writer is used for both so that the order of
+	// standard output and standard error is kept
+	return cmdOutput, cmdOutput
+}
+
+func (o *groupedOutput) Finish(index int, result *CmdResult) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	cmdOutput, ok := o.CmdOutputs[index]
+	if !ok {
+		return
+	}
+	delete(o.CmdOutputs, index)
+	// there is no one to report a write error to, and the
+	// command output should not fail the command
+	_, _ = fmt.Fprintf(o.Writer, "=== %s (%s in %v)\n", result, getResultStatus(result), result.Duration)
+	_ = cmdOutput.WriteToAndClose(o.Writer)
+}
+
+func getResultStatus(result *CmdResult) string {
+	switch {
+	case result.TimedOut:
+		return "timed out"
+	case result.Killed:
+		return "killed"
+	case result.Err == nil:
+		return "passed"
+	case result.ExitCode >= 0:
+		return fmt.Sprintf("failed with exit code %d", result.ExitCode)
+	default:
+		return "failed"
+	}
+}
+
+// groupedCmdOutput buffers the output of a single command, in memory
+// up to the maximum buffer size, and in a temporary file after that.
+type groupedCmdOutput struct {
+	MaxBufferSize int
+	Buffer        bytes.Buffer
+	File          *os.File
+	LastByte      byte
+	Closed        bool
+	Lock          sync.Mutex
+}
+
+func newGroupedCmdOutput(maxBufferSize int) *groupedCmdOutput {
+	return &groupedCmdOutput{MaxBufferSize: maxBufferSize}
+}
+
+func (o *groupedCmdOutput) Write(p []byte) (int, error) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	// output written after the command is finished is dropped
+	if o.Closed || len(p) == 0 {
+		return len(p), nil
+	}
+	o.LastByte = p[len(p)-1]
+	if o.File == nil && o.Buffer.Len()+len(p) > o.MaxBufferSize {
+		// if the temporary file cannot be created, keep buffering
+		// in memory rather than failing the command
+		if file, err := ioutil.TempFile("", "parallel-output-"); err == nil {
+			if _, err := o.Buffer.WriteTo(file); err != nil {
+				_ = file.Close()
+				_ = os.Remove(file.Name())
+				return 0, err
+			}
+			o.File = file
+		}
+	}
+	if o.File != nil {
+		return o.File.Write(p)
+	}
+	return o.Buffer.Write(p)
+}
+
+// WriteToAndClose writes the buffered output to writer, ending in
+// a newline, and releases the buffer and any temporary file.
+func (o *groupedCmdOutput) WriteToAndClose(writer io.Writer) error {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.Closed = true
+	if o.File != nil {
+		defer func() {
+			_ = o.File.Close()
+			_ = os.Remove(o.File.Name())
+		}()
+		if _, err := o.File.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, o.File); err != nil {
+			return err
+		}
+	} else {
+		if _, err := o.Buffer.WriteTo(writer); err != nil {
+			return err
+		}
+	}
+	if o.LastByte != 0 && o.LastByte != '\n' {
+		_, err := writer.Write([]byte{'\n'})
+		return err
+	}
+	return nil
+}
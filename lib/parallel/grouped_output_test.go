@@ -0,0 +1,58 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupedOutput(t *testing.T) {
+	for _, maxBufferSize := range []int{DefaultMaxBufferSize, 4} {
+		buffer := bytes.NewBuffer(nil)
+		output := NewGroupedOutput(buffer, WithMaxBufferSize(maxBufferSize))
+		cmd0 := ExecCmd(exec.Command("foo"))
+		cmd1 := ExecCmd(exec.Command("bar"))
+		stdout0, stderr0 := output.Start(CmdInfo{Index: 0, ID: "0", Cmd: cmd0})
+		stdout1, _ := output.Start(CmdInfo{Index: 1, ID: "1", Name: "second", Cmd: cmd1})
+
+		write(t, stdout0, "hello\n")
+		write(t, stdout1, "one\n")
+		write(t, stderr0, "world")
+		write(t, stdout1, "two\n")
+		assert.Empty(t, buffer.String())
+
+		output.Finish(1, &CmdResult{Cmd: cmd1, ID: "1", Name: "second", ExitCode: 1, Err: errors.New("failed"), Duration: time.Second})
+		output.Finish(0, &CmdResult{Cmd: cmd0, ID: "0", Killed: true, Duration: time.Second})
+		write(t, stdout0, "dropped\n")
+		assert.Equal(
+			t,
+			"=== second (failed with exit code 1 in 1s)\none\ntwo\n"+
+				"=== foo (killed in 1s)\nhello\nworld\n",
+			buffer.String(),
+		)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	limitCPUTime = "cpu_time"
+	limitMemory  = "memory"
+)
+
+var errLimitsNotSupported = errors.New("limits are only supported on Linux")
+
+// limitCmd is a Cmd that can be killed for exceeding its limits.
+type limitCmd interface {
+	LimitExceeded() string
+}
+
+// startWithLimits starts the command with its limits.
+func (e *execCmd) startWithLimits() error {
+	if err := validateLimits(e.Limits); err != nil {
+		return err
+	}
+	var cgroup string
+	if e.Limits.MemoryMax > 0 || e.Limits.CPUs > 0 {
+		var err error
+		if cgroup, err = createCgroup(e.Limits); err != nil {
+			return fmt.Errorf("could not create cgroup: %v", err)
+		}
+	}
+	// the command is started through a shell that applies the
+	// limits, and the exec.Cmd is restored to what it was given
+	// as once started
+	path, args := e.Path, e.Args
+	e.Path, e.Args = getLimitsCmd(e.Limits, cgroup, path, args)
+	err := e.Cmd.Start()
+	e.Path, e.Args = path, args
+	if err != nil {
+		if cgroup != "" {
+			_, _ = removeCgroup(cgroup)
+		}
+		return err
+	}
+	e.Cgroup = cgroup
+	return nil
+}
+
+// finishWithLimits removes the cgroup of the command, and returns
+// the limit it was killed for exceeding, if any. err is the error
+// returned by Wait.
+func (e *execCmd) finishWithLimits(err error) string {
+	var oomKilled bool
+	if e.Cgroup != "" {
+		// descendants of the command may still be in the cgroup
+		_ = killCgroup(e.Cgroup)
+		oomKilled, _ = removeCgroup(e.Cgroup)
+	}
+	switch {
+	case oomKilled:
+		return limitMemory
+	case e.Limits.CPUTime > 0 && getSignal(err) != "" && e.ProcessState != nil:
+		// the CPU time in the rusage can be slightly below the
+		// CPU time the kernel killed the command at
+		cpuTime := e.ProcessState.UserTime() + e.ProcessState.SystemTime()
+		if cpuTime >= time.Duration(getCPUTimeSeconds(e.Limits.CPUTime))*time.Second*9/10 {
+			return limitCPUTime
+		}
+		return ""
+	default:
+		return ""
+	}
+}
+
+func validateLimits(limits *Limits) error {
+	if !limitsSupported {
+		return errLimitsNotSupported
+	}
+	if limits.CPUTime < 0 {
+		return fmt.Errorf("CPU time limit is negative: %v", limits.CPUTime)
+	}
+	if limits.CPUs < 0 {
+		return fmt.Errorf("CPUs limit is negative: %v", limits.CPUs)
+	}
+	if (limits.MemoryMax > 0 || limits.CPUs > 0) && limits.CgroupParent == "" {
+		return errors.New("memory and CPUs limits require a cgroup parent")
+	}
+	return nil
+}
+
+// getCPUTimeSeconds returns the CPU time limit in seconds, rounded up.
+func getCPUTimeSeconds(cpuTime time.Duration) uint64 {
+	return uint64(math.Ceil(cpuTime.Seconds()))
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	limitsSupported = true
+	// rlimitInfinity is RLIM_INFINITY.
+	rlimitInfinity = ^uint64(0)
+	// cpuMaxPeriod is the period of cpu.max in microseconds.
+	cpuMaxPeriod = 100000
+	// cgroupRemoveTimeout is how long to wait for the processes
+	// of a cgroup to exit before giving up on removing it.
+	cgroupRemoveTimeout = time.Second
+)
+
+// numCgroups is the number of cgroups created, used to name them.
+var numCgroups uint64
+
+// getLimitsCmd returns the path and arguments of a shell that
+// moves itself into the cgroup, sets the rlimits, and then executes
+// the command, so that the command has its limits from the start.
+//
+// If the first argument of the command is not its path, the shell
+// executes the command with it as argv[0] if it supports exec -a,
+// and with the path as argv[0] otherwise.
+func getLimitsCmd(limits *Limits, cgroup string, path string, args []string) (string, []string) {
+	script := []string{"set -e"}
+	shellArgs := []string{"sh", "-c", "", "sh"}
+	if cgroup != "" {
+		script = append(script, `echo $$ > "$1"`, "shift")
+		shellArgs = append(shellArgs, filepath.Join(cgroup, "cgroup.procs"))
+	}
+	for _, rlimit := range []struct {
+		resource int
+		flag     string
+		value    uint64
+	}{
+		// the address space is in kilobytes for ulimit
+		{syscall.RLIMIT_AS, "-v", (limits.AddressSpace + 1023) / 1024},
+		{syscall.RLIMIT_NOFILE, "-n", limits.OpenFiles},
+		{syscall.RLIMIT_CPU, "-t", getCPUTimeSeconds(limits.CPUTime)},
+	} {
+		if rlimit.value == 0 {
+			continue
+		}
+		script = append(script, fmt.Sprintf("ulimit %s %d", rlimit.flag, getRlimitValue(rlimit.resource, rlimit.value, rlimit.flag == "-v")))
+	}
+	if len(args) > 0 && args[0] != path {
+		// exec -a is not POSIX, so it is tried in a subshell first
+		script = append(
+			script,
+			`argv0="$1"`,
+			"shift",
+			`if (exec -a "$argv0" true) 2>/dev/null; then exec -a "$argv0" "$@"; fi`,
+		)
+		shellArgs = append(shellArgs, args[0])
+	}
+	script = append(script, `exec "$@"`)
+	shellArgs[2] = strings.Join(script, "; ")
+	shellArgs = append(shellArgs, path)
+	if len(args) > 1 {
+		shellArgs = append(shellArgs, args[1:]...)
+	}
+	return "/bin/sh", shellArgs
+}
+
+// getRlimitValue returns value, or the hard limit of the current
+// process if value is above it, as only privileged processes can
+// raise their hard limit. If kilobytes is true, value is in kilobytes
+// and the rlimit is in bytes.
+func getRlimitValue(resource int, value uint64, kilobytes bool) uint64 {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &rlimit); err != nil || rlimit.Max == rlimitInfinity {
+		return value
+	}
+	max := rlimit.Max
+	if kilobytes {
+		max /= 1024
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// createCgroup creates a new cgroup in the cgroup parent with the
+// memory and CPU limits, and returns its path.
+func createCgroup(limits *Limits) (string, error) {
+	// the controllers may already be enabled, or may not be
+	// enabled by a process that is in the cgroup parent itself,
+	// in which case setting the limits below fails
+	for _, controller := range []string{"+memory", "+cpu"} {
+		_ = writeCgroupFile(limits.CgroupParent, "cgroup.subtree_control", controller)
+	}
+	cgroup := filepath.Join(
+		limits.CgroupParent,
+		fmt.Sprintf("parallel-%d-%d", os.Getpid(), atomic.AddUint64(&numCgroups, 1)),
+	)
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return "", err
+	}
+	err := func() error {
+		if limits.MemoryMax > 0 {
+			if err := writeCgroupFile(cgroup, "memory.max", strconv.FormatUint(limits.MemoryMax, 10)); err != nil {
+				return err
+			}
+			// swap would keep the command from being killed, and
+			// the file does not exist if swap is not enabled
+			_ = writeCgroupFile(cgroup, "memory.swap.max", "0")
+		}
+		if limits.CPUs > 0 {
+			quota := int64(limits.CPUs * cpuMaxPeriod)
+			if err := writeCgroupFile(cgroup, "cpu.max", fmt.Sprintf("%d %d", quota, cpuMaxPeriod)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		_ = os.Remove(cgroup)
+		return "", err
+	}
+	return cgroup, nil
+}
+
+// killCgroup kills all processes in the cgroup.
+func killCgroup(cgroup string) error {
+	// cgroup.kill only exists as of Linux 5.14
+	if err := writeCgroupFile(cgroup, "cgroup.kill", "1"); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, field := range bytes.Fields(data) {
+		if pid, err := strconv.Atoi(string(field)); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// removeCgroup removes the cgroup once its processes have exited,
+// and returns true if any process in it was killed for exceeding
+// the memory limit.
+func removeCgroup(cgroup string) (bool, error) {
+	oomKilled := getCgroupEvent(cgroup, "memory.events", "oom_kill") > 0
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := os.Remove(cgroup)
+		if err == nil || os.IsNotExist(err) {
+			return oomKilled, nil
+		}
+		if time.Now().After(deadline) {
+			return oomKilled, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// getCgroupEvent returns the value of the key in the flat keyed
+// file of the cgroup, or 0 if it is not found.
+func getCgroupEvent(cgroup string, fileName string, key string) int64 {
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, fileName))
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 2 && string(fields[0]) == key {
+			value, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+func writeCgroupFile(cgroup string, fileName string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup, fileName), []byte(value), 0644)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCgroup(t *testing.T) {
+	// a plain directory stands in for the cgroup parent
+	cgroupParent, err := ioutil.TempDir("", "parallel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(cgroupParent) }()
+	cgroup, err := createCgroup(&Limits{CgroupParent: cgroupParent, MemoryMax: 1 << 20, CPUs: 1.5})
+	require.NoError(t, err)
+	require.Equal(t, cgroupParent, filepath.Dir(cgroup))
+	for fileName, expected := range map[string]string{
+		"memory.max":      "1048576",
+		"memory.swap.max": "0",
+		"cpu.max":         "150000 100000",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(cgroup, fileName))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(data))
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cgroup, "memory.events"), []byte("oom 1\noom_kill 2\n"), 0644))
+	require.Equal(t, int64(2), getCgroupEvent(cgroup, "memory.events", "oom_kill"))
+	require.Equal(t, int64(0), getCgroupEvent(cgroup, "memory.events", "max"))
+}
+
+func TestGetLimitsCmdArgv0(t *testing.T) {
+	path, args := getLimitsCmd(&Limits{OpenFiles: 64}, "", "/bin/cat", []string{"cat-argv0", "/proc/self/cmdline"})
+	expected := "cat-argv0"
+	if exec.Command(path, "-c", "(exec -a argv0 true) 2>/dev/null").Run() != nil {
+		expected = "/bin/cat"
+	}
+	output, err := (&exec.Cmd{Path: path, Args: args}).Output()
+	require.NoError(t, err)
+	require.Equal(t, expected+"\x00/proc/self/cmdline\x00", string(output))
+
+	// bash supports exec -a, as the default /bin/sh may not
+	bashPath, err := exec.LookPath("bash")
+	if err != nil {
+		return
+	}
+	output, err = (&exec.Cmd{Path: bashPath, Args: args}).Output()
+	require.NoError(t, err)
+	require.Equal(t, "cat-argv0\x00/proc/self/cmdline\x00", string(output))
+}
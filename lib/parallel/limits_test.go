@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only supported on Linux")
+	}
+	cmds := []*exec.Cmd{
+		exec.Command("sh", "-c", "ulimit -n"),
+		exec.Command("sh", "-c", "while :; do :; done"),
+	}
+	testEnv := newTestEnv(2, cmds)
+	tasks := []*Task{
+		{ID: "a", Cmd: ExecCmd(cmds[0], WithLimits(Limits{OpenFiles: 16}))},
+		{ID: "b", Cmd: ExecCmd(cmds[1], WithLimits(Limits{CPUTime: 500 * time.Millisecond}))},
+	}
+	err := testEnv.runner.RunTasks(context.Background(), tasks)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "(exceeded cpu_time limit)")
+	results := err.(*RunError).Results
+	require.NoError(t, results[0].Err)
+	require.Empty(t, results[0].LimitExceeded)
+	require.Equal(t, limitCPUTime, results[1].LimitExceeded)
+	require.Equal(t, []string{"16"}, testEnv.stdout.Lines(t))
+
+	event := testEnv.eventHandler.OneEventForTypeError(t, EventTypeCmdFinished)
+	require.Equal(t, limitCPUTime, event.Cmd.LimitExceeded)
+	require.Equal(t, limitCPUTime, event.Fields["limit_exceeded"])
+	require.Contains(t, event.Error, "command exceeded cpu_time limit")
+}
+
+func TestValidateLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only supported on Linux")
+	}
+	require.NoError(t, validateLimits(&Limits{OpenFiles: 1}))
+	require.EqualError(t, validateLimits(&Limits{CPUs: -1}), "CPUs limit is negative: -1")
+	require.EqualError(t, validateLimits(&Limits{MemoryMax: 1}), "memory and CPUs limits require a cgroup parent")
+}
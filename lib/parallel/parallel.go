@@ -21,9 +21,12 @@
 package parallel
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"os/exec"
 	"runtime"
 	"time"
@@ -40,14 +43,59 @@ var (
 	DefaultEventHandler = logEvent
 	// DefaultClock is the default function to use as a clock.
 	DefaultClock = time.Now
+	// DefaultMaxQueuedCmds is the default value for the maximum
+	// number of commands submitted to a Pool that have not
+	// started yet.
+	DefaultMaxQueuedCmds = 128
+	// DefaultSignals are the signals that interrupt a run by default.
+	DefaultSignals = []os.Signal{os.Interrupt}
 )
 
 // Event is an event that happens during the runner's Run call.
+//
+// Fields contains the same information as the typed fields as strings
+// and numbers, and is kept for existing consumers of the events.
 type Event struct {
-	Type   EventType              `json:"type,omitempty" yaml:"type,omitempty"`
-	Time   time.Time              `json:"time,omitempty" yaml:"time,omitempty"`
-	Fields map[string]interface{} `json:"fields,omitempty" yaml:"fields,omitempty"`
-	Error  string                 `json:"error,omitempty" yaml:"error,omitempty"`
+	Type EventType `json:"type,omitempty" yaml:"type,omitempty"`
+	Time time.Time `json:"time,omitempty" yaml:"time,omitempty"`
+	// RunID identifies the run the Event happened in.
+	RunID string `json:"run_id,omitempty" yaml:"run_id,omitempty"`
+	// Cmd is the command the Event is for, if any.
+	Cmd *EventCmd `json:"cmd,omitempty" yaml:"cmd,omitempty"`
+	// Duration is how long the command or the run took, and
+	// is in nanoseconds in JSON.
+	Duration time.Duration `json:"duration_ns,omitempty" yaml:"duration_ns,omitempty"`
+	// Attempt is the attempt the command finished after, or the
+	// attempt that is about to start for a cmd_retried Event.
+	Attempt int                    `json:"attempt,omitempty" yaml:"attempt,omitempty"`
+	Fields  map[string]interface{} `json:"fields,omitempty" yaml:"fields,omitempty"`
+	Error   string                 `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// EventCmd is the command an Event is for.
+type EventCmd struct {
+	// Index is the index of the command in the run.
+	Index int `json:"index" yaml:"index"`
+	// ID is the ID of the Task of the command.
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// Name is the name of the Task of the command, or the string
+	// representation of the command if the Task has no name.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// PID is the process ID of the last attempt of the command,
+	// if it is a process that was started.
+	PID int `json:"pid,omitempty" yaml:"pid,omitempty"`
+	// ExitCode is the exit code of the command, if it exited on
+	// its own with an exit code.
+	ExitCode *int `json:"exit_code,omitempty" yaml:"exit_code,omitempty"`
+	// Signal describes the signal that terminated the command,
+	// such as "killed", if it was terminated by a signal.
+	Signal string `json:"signal,omitempty" yaml:"signal,omitempty"`
+	// ResourceUsage is the resources used by all attempts of the
+	// command, if it is finished and implements ResourceUsageCmd.
+	ResourceUsage *ResourceUsage `json:"resource_usage,omitempty" yaml:"resource_usage,omitempty"`
+	// LimitExceeded is the limit the command was killed for
+	// exceeding, either "cpu_time" or "memory", if any.
+	LimitExceeded string `json:"limit_exceeded,omitempty" yaml:"limit_exceeded,omitempty"`
 }
 
 // RunnerOption is an option for a new Runner.
@@ -61,6 +109,16 @@ func WithFastFail() RunnerOption {
 	}
 }
 
+// WithFailureThreshold returns a RunnerOption that will return error
+// from Run as soon as enough of the commands failed to reach the
+// threshold. The commands that are still running are killed, and the
+// remaining commands are not started, as with fast fail.
+func WithFailureThreshold(failureThreshold FailureThreshold) RunnerOption {
+	return func(runner *runner) {
+		runner.FailureThreshold = &failureThreshold
+	}
+}
+
 // WithMaxConcurrentCmds returns a RunnerOption that will make the
 // Runner only run maxConcurrentCmds at once, or unlimited if 0.
 func WithMaxConcurrentCmds(maxConcurrentCmds int) RunnerOption {
@@ -69,6 +127,168 @@ func WithMaxConcurrentCmds(maxConcurrentCmds int) RunnerOption {
 	}
 }
 
+// WithMaxQueuedCmds returns a RunnerOption that will make Submit on
+// a Pool started by the Runner block while maxQueuedCmds submitted
+// commands have not started yet, or never if 0.
+func WithMaxQueuedCmds(maxQueuedCmds int) RunnerOption {
+	return func(runner *runner) {
+		runner.MaxQueuedCmds = maxQueuedCmds
+	}
+}
+
+// WithStartRate returns a RunnerOption that will make the Runner
+// start commands at most at the given rate, in addition to the
+// maximum number of concurrent commands. Commands that wait to be
+// started hold their command slots and resource pools.
+//
+// Commands that are retried are not limited when they are
+// started again.
+func WithStartRate(startRate StartRate) RunnerOption {
+	return func(runner *runner) {
+		runner.StartRate = &startRate
+	}
+}
+
+// WithCmdTimeout returns a RunnerOption that will kill any command
+// that runs for longer than cmdTimeout, or never if 0.
+func WithCmdTimeout(cmdTimeout time.Duration) RunnerOption {
+	return func(runner *runner) {
+		runner.CmdTimeout = cmdTimeout
+	}
+}
+
+// WithRunTimeout returns a RunnerOption that will kill all remaining
+// commands and return error if the run takes longer than runTimeout,
+// or never if 0.
+func WithRunTimeout(runTimeout time.Duration) RunnerOption {
+	return func(runner *runner) {
+		runner.RunTimeout = runTimeout
+	}
+}
+
+// WithGracefulTermination returns a RunnerOption that will make the
+// Runner stop commands by first sending them signal, and then killing
+// them if they have not exited after gracePeriod.
+//
+// Only commands that implement SignalCmd can be sent a signal, other
+// commands are killed immediately.
+func WithGracefulTermination(signal os.Signal, gracePeriod time.Duration) RunnerOption {
+	return func(runner *runner) {
+		runner.StopSignal = signal
+		runner.StopGracePeriod = gracePeriod
+	}
+}
+
+// WithSignals returns a RunnerOption that will make the Runner stop
+// a run when the process receives any of signals, instead of the
+// DefaultSignals. The signals are only handled while a run is active.
+//
+// If no signals are given, the Runner does not handle signals, as
+// with WithoutSignalHandling.
+func WithSignals(signals ...os.Signal) RunnerOption {
+	return func(runner *runner) {
+		runner.Signals = signals
+	}
+}
+
+// WithoutSignalHandling returns a RunnerOption that will make the
+// Runner not handle any signals, leaving them to the program that
+// embeds it. Runs can still be stopped by cancelling their context.
+func WithoutSignalHandling() RunnerOption {
+	return func(runner *runner) {
+		runner.Signals = nil
+	}
+}
+
+// WithSignalForwarding returns a RunnerOption that will make the
+// Runner forward the signal that stops a run to the running commands
+// instead of their stop signal, and then kill them if they have not
+// exited after gracePeriod.
+//
+// Only commands that implement SignalCmd can be sent a signal, other
+// commands are killed immediately.
+func WithSignalForwarding(gracePeriod time.Duration) RunnerOption {
+	return func(runner *runner) {
+		runner.ForwardSignals = true
+		runner.ForwardGracePeriod = gracePeriod
+	}
+}
+
+// WithChildSubreaper returns a RunnerOption that will make the
+// process a child subreaper, so that descendants of the commands that
+// are orphaned are re-parented to the process instead of init. Once
+// all commands are done, any such descendants that are still in the
+// process group of a command are killed and reaped, with an
+// orphan_reaped Event for each.
+//
+// Only commands that run in their own process group with
+// WithProcessGroup have their orphans reaped, so that other children
+// of the process, such as the commands of other runs, are never
+// reaped. Orphans that left the process group of their command are
+// re-parented to the process but not reaped by the Runner.
+//
+// This affects the whole process, and is only supported on Linux.
+func WithChildSubreaper() RunnerOption {
+	return func(runner *runner) {
+		runner.ChildSubreaper = true
+	}
+}
+
+// WithAdaptiveConcurrency returns a RunnerOption that will make the
+// Runner adapt the maximum number of concurrent commands to the load
+// of the system, between the bounds of adaptiveConcurrency, instead
+// of using the maximum set with WithMaxConcurrentCmds.
+//
+// The maximum starts at the number of CPUs within the bounds, and a
+// concurrency_changed Event is sent every time it changes. Commands
+// that are running when the maximum is lowered are not stopped.
+func WithAdaptiveConcurrency(adaptiveConcurrency AdaptiveConcurrency) RunnerOption {
+	return func(runner *runner) {
+		runner.AdaptiveConcurrency = &adaptiveConcurrency
+	}
+}
+
+// WithRetryPolicy returns a RunnerOption that will make the Runner
+// retry failed commands according to retryPolicy.
+func WithRetryPolicy(retryPolicy RetryPolicy) RunnerOption {
+	return func(runner *runner) {
+		runner.RetryPolicy = &retryPolicy
+	}
+}
+
+// WithResourcePool returns a RunnerOption that will register a named
+// resource pool, so that at most capacity commands whose Task lists
+// name in Resources run at once.
+//
+// A command only starts once it can take its weight in command slots
+// and a unit of every pool it uses at the same time, so commands that
+// use several pools cannot deadlock.
+func WithResourcePool(name string, capacity int) RunnerOption {
+	return func(runner *runner) {
+		if runner.ResourcePools == nil {
+			runner.ResourcePools = make(map[string]int)
+		}
+		runner.ResourcePools[name] = capacity
+	}
+}
+
+// WithSchedulingOrder returns a RunnerOption that will make the Runner
+// start ready commands in the given order, such as LongestFirst,
+// instead of SubmissionOrder.
+func WithSchedulingOrder(schedulingOrder SchedulingOrder) RunnerOption {
+	return func(runner *runner) {
+		runner.SchedulingOrder = schedulingOrder
+	}
+}
+
+// WithOutput returns a RunnerOption that will make the Runner
+// redirect the output of commands that implement OutputCmd to output.
+func WithOutput(output Output) RunnerOption {
+	return func(runner *runner) {
+		runner.Output = output
+	}
+}
+
 // WithEventHandler returns a RunnerOption that will use the
 // given EventHandler.
 func WithEventHandler(eventHandler func(*Event)) RunnerOption {
@@ -77,6 +297,18 @@ func WithEventHandler(eventHandler func(*Event)) RunnerOption {
 	}
 }
 
+// WithResultsHandler returns a RunnerOption that will give the
+// results of every command to resultsHandler once a run is done,
+// whether it failed or not, before Run returns.
+//
+// This gives access to the results of a run that succeeded, such as
+// the commands that only passed after being retried.
+func WithResultsHandler(resultsHandler func([]*CmdResult)) RunnerOption {
+	return func(runner *runner) {
+		runner.ResultsHandler = resultsHandler
+	}
+}
+
 // WithClock returns a RunnerOption that will make the Runner
 // use the given Clock.
 func WithClock(clock func() time.Time) RunnerOption {
@@ -97,27 +329,256 @@ type Cmd interface {
 	Kill() error
 }
 
+// ContextCmd is a Cmd that is context-aware.
+//
+// If a Cmd implements ContextCmd, the Runner will call StartContext
+// instead of Start. The context is cancelled when the command is
+// killed or the Runner is done.
+type ContextCmd interface {
+	Cmd
+
+	// Start the command with the given context.
+	StartContext(ctx context.Context) error
+}
+
+// SignalCmd is a Cmd that can be sent a signal.
+//
+// Cmds returned by ExecCmd implement SignalCmd.
+type SignalCmd interface {
+	Cmd
+
+	// Signal sends the signal to the command.
+	Signal(sig os.Signal) error
+}
+
+// RetryableCmd is a Cmd that can be started again after it finishes.
+//
+// Cmds returned by ExecCmd implement RetryableCmd.
+type RetryableCmd interface {
+	Cmd
+
+	// Reset the command so that it can be started again.
+	Reset() error
+}
+
+// OutputCmd is a Cmd whose output can be redirected.
+//
+// Cmds returned by ExecCmd implement OutputCmd.
+type OutputCmd interface {
+	Cmd
+
+	// SetOutput sets the writers for the standard output and
+	// standard error of the command. It is called before the
+	// command is started.
+	SetOutput(stdout io.Writer, stderr io.Writer)
+}
+
+// ResourceUsageCmd is a Cmd that reports the resources it used.
+//
+// Cmds returned by ExecCmd implement ResourceUsageCmd.
+type ResourceUsageCmd interface {
+	Cmd
+
+	// ResourceUsage returns the resources used by the last run of
+	// the command, or nil if they are not known. It is called after
+	// Wait returns.
+	ResourceUsage() *ResourceUsage
+}
+
+// ResourceUsage is the resources used by a command.
+//
+// Fields that are not supported on the current platform are 0.
+type ResourceUsage struct {
+	// UserTime is the user CPU time, and is in nanoseconds in JSON.
+	UserTime time.Duration `json:"user_time_ns" yaml:"user_time_ns"`
+	// SystemTime is the system CPU time, and is in nanoseconds in JSON.
+	SystemTime time.Duration `json:"system_time_ns" yaml:"system_time_ns"`
+	// MaxRSS is the maximum resident set size in bytes.
+	MaxRSS int64 `json:"max_rss_bytes" yaml:"max_rss_bytes"`
+	// VoluntaryContextSwitches is the number of voluntary
+	// context switches.
+	VoluntaryContextSwitches int64 `json:"voluntary_ctx_switches" yaml:"voluntary_ctx_switches"`
+	// InvoluntaryContextSwitches is the number of involuntary
+	// context switches.
+	InvoluntaryContextSwitches int64 `json:"involuntary_ctx_switches" yaml:"involuntary_ctx_switches"`
+}
+
+// add adds the resources used by another run of the command,
+// keeping the largest MaxRSS.
+func (u *ResourceUsage) add(other *ResourceUsage) {
+	u.UserTime += other.UserTime
+	u.SystemTime += other.SystemTime
+	if other.MaxRSS > u.MaxRSS {
+		u.MaxRSS = other.MaxRSS
+	}
+	u.VoluntaryContextSwitches += other.VoluntaryContextSwitches
+	u.InvoluntaryContextSwitches += other.InvoluntaryContextSwitches
+}
+
+// CmdInfo identifies a command run by a Runner.
+type CmdInfo struct {
+	// Index is the index of the command in the run.
+	Index int
+	// ID is the ID of the Task of the command, which is unique
+	// within the run.
+	ID string
+	// Name is the name of the Task of the command, if any.
+	Name string
+	// Cmd is the command.
+	Cmd Cmd
+}
+
+// String returns the name of the command, or the string
+// representation of the command if it has no name.
+func (c CmdInfo) String() string {
+	return getCmdName(c.Name, c.Cmd)
+}
+
+// Output handles the output of the commands run by a Runner.
+type Output interface {
+	// Start is called before the given command is first started,
+	// and returns the writers for its standard output and
+	// standard error.
+	Start(info CmdInfo) (stdout io.Writer, stderr io.Writer)
+	// Finish is called once the command at the given index is
+	// finished, including if it was killed, and must flush any
+	// buffered output of the command.
+	Finish(index int, result *CmdResult)
+}
+
+// ExecCmdOption is an option for a new Cmd returned by ExecCmd.
+type ExecCmdOption func(*execCmd)
+
+// WithProcessGroup returns an ExecCmdOption that will start the
+// command in its own process group, and send signals to and kill
+// the whole process group instead of just the direct child.
+//
+// This is only supported on Unix systems.
+func WithProcessGroup() ExecCmdOption {
+	return func(execCmd *execCmd) {
+		execCmd.ProcessGroup = true
+	}
+}
+
+// Limits are the resource limits of a command. Zero values mean
+// no limit.
+type Limits struct {
+	// AddressSpace is the maximum size of the virtual memory of the
+	// command in bytes, as RLIMIT_AS.
+	AddressSpace uint64
+	// OpenFiles is the maximum number of open file descriptors of
+	// the command, as RLIMIT_NOFILE.
+	OpenFiles uint64
+	// CPUTime is the maximum CPU time of the command, as RLIMIT_CPU,
+	// rounded up to the second.
+	CPUTime time.Duration
+	// CgroupParent is the cgroup v2 directory, such as
+	// /sys/fs/cgroup/ci, to create a cgroup for the command in.
+	// It must be delegated to the user of the process, and is
+	// required for MemoryMax and CPUs.
+	CgroupParent string
+	// MemoryMax is the maximum memory of the command and its
+	// descendants in bytes, as the memory.max of its cgroup.
+	MemoryMax uint64
+	// CPUs is the maximum number of CPUs the command and its
+	// descendants can use, as the cpu.max of its cgroup.
+	CPUs float64
+}
+
+// WithLimits returns an ExecCmdOption that will apply limits to the
+// command when it is started.
+//
+// The command is started by /bin/sh, which moves itself into the
+// cgroup and sets the rlimits before executing the command, so that
+// the command and all its descendants are limited from the start.
+// Rlimits apply to each process on its own, while the cgroup limits
+// apply to all of them together. The command keeps its first argument
+// as argv[0] if /bin/sh supports exec -a, as bash and busybox do, and
+// otherwise gets its path as argv[0].
+//
+// Commands that are killed for exceeding CPUTime or MemoryMax have
+// the limit they exceeded in the cmd_finished Event and their
+// CmdResult. This is only supported on Linux.
+func WithLimits(limits Limits) ExecCmdOption {
+	return func(execCmd *execCmd) {
+		execCmd.Limits = &limits
+	}
+}
+
 // ExecCmd returns a new Cmd for the given exec.Cmd.
-func ExecCmd(cmd *exec.Cmd) Cmd {
-	return newExecCmd(cmd)
+func ExecCmd(cmd *exec.Cmd, options ...ExecCmdOption) Cmd {
+	return newExecCmd(cmd, options...)
 }
 
 // ExecCmds returns a slice of Cmds for the given exec.Cmds.
-func ExecCmds(cmds []*exec.Cmd) []Cmd {
+func ExecCmds(cmds []*exec.Cmd, options ...ExecCmdOption) []Cmd {
 	execCmds := make([]Cmd, len(cmds))
 	for i, cmd := range cmds {
-		execCmds[i] = ExecCmd(cmd)
+		execCmds[i] = ExecCmd(cmd, options...)
 	}
 	return execCmds
 }
 
+// FuncCmd returns a new Cmd that runs f on its own goroutine, where
+// name is returned by String.
+//
+// The context given to f is cancelled when the command is killed, and
+// f must return once it is done. A panic in f is recovered and makes
+// the command fail with an error.
+//
+// Cmds returned by FuncCmd implement ContextCmd and RetryableCmd.
+func FuncCmd(name string, f func(ctx context.Context) error) Cmd {
+	return newFuncCmd(name, f)
+}
+
 // Runner runs the commands.
 type Runner interface {
 	// Run the commands.
 	//
 	// Return error if there was an initialization error, or any of
 	// the running commands returned with a non-zero exit code.
+	// If the run fails, the error is a *RunError that contains
+	// the result of every command.
 	Run(cmds []Cmd) error
+	// Run the commands with the given context.
+	//
+	// If the context is cancelled or its deadline is exceeded, all
+	// remaining commands are killed and an error wrapping ctx.Err()
+	// is returned.
+	RunContext(ctx context.Context, cmds []Cmd) error
+	// Run the Tasks with the given context.
+	//
+	// A Task is only started once all the Tasks it depends on have
+	// finished successfully, and is skipped otherwise. Return error
+	// without running anything if the Tasks have unknown or
+	// duplicate IDs, or have a dependency cycle.
+	RunTasks(ctx context.Context, tasks []*Task) error
+	// Start a Pool with the given context, which runs commands as
+	// they are submitted until it is closed.
+	//
+	// Wait must be called on the Pool to release its resources.
+	Start(ctx context.Context) (Pool, error)
+}
+
+// Pool runs commands that are submitted while other commands run.
+//
+// Commands are started in the order they were submitted, and the
+// options of the Runner that started the Pool apply as for Run.
+type Pool interface {
+	// Submit a command to run.
+	//
+	// Block while the maximum number of queued commands have not
+	// started yet. Return error if the Pool is closed, or is done
+	// because it failed fast, timed out, or was interrupted.
+	Submit(cmd Cmd) error
+	// Close the Pool so that no more commands can be submitted.
+	Close()
+	// Wait for the Pool to be done, and return the same error
+	// as Run for the submitted commands.
+	//
+	// The Pool is done once it is closed and all the submitted
+	// commands are finished, or when it stops early.
+	Wait() error
 }
 
 // NewRunner returns a new Runner.
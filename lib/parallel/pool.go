@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errPoolClosed = errors.New("pool is closed")
+	errPoolDone   = errors.New("pool is done")
+	errCmdNil     = errors.New("command is nil")
+)
+
+type pool struct {
+	ActiveRun *activeRun
+	WaitOnce  sync.Once
+	Err       error
+}
+
+func newPool(activeRun *activeRun) *pool {
+	return &pool{activeRun, sync.Once{}, nil}
+}
+
+func (p *pool) Submit(cmd Cmd) error {
+	if cmd == nil {
+		return errCmdNil
+	}
+	select {
+	case <-p.ActiveRun.State.DoneC:
+		return errPoolDone
+	default:
+	}
+	if !p.ActiveRun.Scheduler.Add(cmd) {
+		select {
+		case <-p.ActiveRun.State.DoneC:
+			return errPoolDone
+		default:
+			return errPoolClosed
+		}
+	}
+	return nil
+}
+
+func (p *pool) Close() {
+	p.ActiveRun.Scheduler.Close()
+}
+
+func (p *pool) Wait() error {
+	p.WaitOnce.Do(func() {
+		p.Err = p.ActiveRun.Wait()
+	})
+	return p.Err
+}
+
+func (r *runner) Start(ctx context.Context) (Pool, error) {
+	activeRun, err := r.start(ctx, nil, nil, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return newPool(activeRun), nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	testEnv := newTestEnv(2, cmds)
+	pool, err := testEnv.runner.Start(context.Background())
+	require.NoError(t, err)
+	for _, cmd := range ExecCmds(cmds) {
+		require.NoError(t, pool.Submit(cmd))
+	}
+	pool.Close()
+	require.Equal(t, errPoolClosed, pool.Submit(ExecCmd(newSimpleCmd(0, "4", 0))))
+	require.NoError(t, pool.Wait())
+	require.NoError(t, pool.Wait())
+
+	testEnv.eventHandler.StartedEventSuccess(t)
+	testEnv.eventHandler.FinishedEventSuccess(t)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 3)
+	require.Equal(t, []string{"1", "2", "3"}, testEnv.stdout.SortedLines(t))
+}
+
+func TestPoolAddDone(t *testing.T) {
+	runnerPool, err := newRunner(WithEventHandler(func(*Event) {})).Start(context.Background())
+	require.NoError(t, err)
+	activeRun := runnerPool.(*pool).ActiveRun
+	activeRun.State.Done()
+	// a Task is not added once the run is done, even if the backlog
+	// has room for it
+	for i := 0; i < 10; i++ {
+		require.False(t, activeRun.Scheduler.Add(newTestNopCmd("nop", nil, nil)))
+	}
+	require.Empty(t, activeRun.Scheduler.Tasks)
+	require.Len(t, activeRun.Scheduler.BacklogC, 0)
+	require.Equal(t, errPoolDone, runnerPool.Submit(newTestNopCmd("nop", nil, nil)))
+	require.NoError(t, runnerPool.Wait())
+}
+
+func TestPoolEmpty(t *testing.T) {
+	pool, err := newRunner(WithEventHandler(func(*Event) {})).Start(context.Background())
+	require.NoError(t, err)
+	pool.Close()
+	require.NoError(t, pool.Wait())
+}
+
+func TestPoolBackpressure(t *testing.T) {
+	pool, err := newRunner(
+		WithMaxConcurrentCmds(1),
+		WithMaxQueuedCmds(1),
+		WithEventHandler(func(*Event) {}),
+	).Start(context.Background())
+	require.NoError(t, err)
+	cmds := make([]*testBlockingCmd, 3)
+	for i := range cmds {
+		cmds[i] = newTestBlockingCmd(strconv.Itoa(i))
+	}
+	require.NoError(t, pool.Submit(cmds[0]))
+	<-cmds[0].startedC
+	// the second command waits for the first one to finish, and
+	// fills the queue
+	require.NoError(t, pool.Submit(cmds[1]))
+	submittedC := make(chan struct{})
+	go func() {
+		defer close(submittedC)
+		require.NoError(t, pool.Submit(cmds[2]))
+	}()
+	select {
+	case <-submittedC:
+		require.Fail(t, "submit did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cmds[0].Release()
+	<-submittedC
+	cmds[1].Release()
+	cmds[2].Release()
+	pool.Close()
+	require.NoError(t, pool.Wait())
+}
+
+func TestPoolFastFail(t *testing.T) {
+	pool, err := newRunner(
+		WithFastFail(),
+		WithEventHandler(func(*Event) {}),
+	).Start(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, pool.Submit(newTestNopCmd("1", nil, errors.New("failed"))))
+	// the pool is done without being closed
+	err = pool.Wait()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	require.Len(t, err.(*RunError).Results, 1)
+	require.Equal(t, errPoolDone, pool.Submit(newTestNopCmd("2", nil, nil)))
+}
+
+// testBlockingCmd is a Cmd that runs until it is released or killed.
+type testBlockingCmd struct {
+	name        string
+	startedC    chan struct{}
+	releasedC   chan struct{}
+	releaseOnce sync.Once
+}
+
+func newTestBlockingCmd(name string) *testBlockingCmd {
+	return &testBlockingCmd{name, make(chan struct{}), make(chan struct{}), sync.Once{}}
+}
+
+func (c *testBlockingCmd) Start() error {
+	close(c.startedC)
+	return nil
+}
+
+func (c *testBlockingCmd) Wait() error {
+	<-c.releasedC
+	return nil
+}
+
+func (c *testBlockingCmd) Kill() error {
+	c.Release()
+	return nil
+}
+
+func (c *testBlockingCmd) Release() {
+	c.releaseOnce.Do(func() { close(c.releasedC) })
+}
+
+func (c *testBlockingCmd) String() string {
+	return c.name
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// maxLineLength is the maximum length of a line that is buffered
+// before it is written even though it is not complete.
+const maxLineLength = 64 * 1024
+
+// colors are the ANSI color codes used for prefixes.
+var colors = []string{"31", "32", "33", "34", "35", "36"}
+
+// PrefixFunc returns the prefix for the output lines of the
+// given command.
+type PrefixFunc func(info CmdInfo) string
+
+// IndexPrefix is a PrefixFunc that returns the index of the command.
+func IndexPrefix(info CmdInfo) string {
+	return strconv.Itoa(info.Index)
+}
+
+// NamePrefix is a PrefixFunc that returns the name of the command,
+// or its ID if it has no name.
+func NamePrefix(info CmdInfo) string {
+	if info.Name != "" {
+		return info.Name
+	}
+	return info.ID
+}
+
+// CmdPrefix is a PrefixFunc that returns the command string.
+func CmdPrefix(info CmdInfo) string {
+	return info.Cmd.String()
+}
+
+// PrefixedOutputOption is an option for a new prefixed Output.
+type PrefixedOutputOption func(*prefixedOutput)
+
+// WithPrefixFunc returns a PrefixedOutputOption that will make
+// the Output use the given PrefixFunc instead of NamePrefix.
+func WithPrefixFunc(prefixFunc PrefixFunc) PrefixedOutputOption {
+	return func(prefixedOutput *prefixedOutput) {
+		prefixedOutput.PrefixFunc = prefixFunc
+	}
+}
+
+// WithColor returns a PrefixedOutputOption that will make the
+// Output color the prefixes using ANSI escape codes.
+func WithColor() PrefixedOutputOption {
+	return func(prefixedOutput *prefixedOutput) {
+		prefixedOutput.Color = true
+	}
+}
+
+// NewPrefixedOutput returns a new Output that writes the output of
+// the commands to stdout and stderr line by line, with each line
+// prefixed by "[prefix] ".
+//
+// Lines are buffered until they are complete, so that lines from
+// different commands are never torn. Any incomplete last line is
+// written when the command finishes.
+func NewPrefixedOutput(stdout io.Writer, stderr io.Writer, options ...PrefixedOutputOption) Output {
+	return newPrefixedOutput(stdout, stderr, options...)
+}
+
+type prefixedOutput struct {
+	Stdout      io.Writer
+	Stderr      io.Writer
+	PrefixFunc  PrefixFunc
+	Color       bool
+	LineWriters map[int][]*lineWriter
+	// Lock guards LineWriters, and writes to Stdout and Stderr
+	Lock sync.Mutex
+}
+
+func newPrefixedOutput(stdout io.Writer, stderr io.Writer, options ...PrefixedOutputOption) *prefixedOutput {
+	prefixedOutput := &prefixedOutput{
+		stdout,
+		stderr,
+		NamePrefix,
+		false,
+		make(map[int][]*lineWriter),
+		sync.Mutex{},
+	}
+	for _, option := range options {
+		option(prefixedOutput)
+	}
+	return prefixedOutput
+}
+
+func (o *prefixedOutput) Start(info CmdInfo) (io.Writer, io.Writer) {
+	prefix := "[" + o.PrefixFunc(info) + "] "
+	if o.Color {
+		prefix = "\x1b[" + colors[info.Index%len(colors)] + "m" + prefix + "\x1b[0m"
+	}
+	stdout := newLineWriter(o, o.Stdout, prefix)
+	stderr := newLineWriter(o, o.Stderr, prefix)
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.LineWriters[info.Index] = []*lineWriter{stdout, stderr}
+	return stdout, stderr
+}
+
+func (o *prefixedOutput) Finish(index int, result *CmdResult) {
+	o.Lock.Lock()
+	lineWriters := o.LineWriters[index]
+	delete(o.LineWriters, index)
+	o.Lock.Unlock()
+	for _, lineWriter := range lineWriters {
+		// there is no one to report a write error to, and the
+		// command output should not fail the command
+		_ = lineWriter.Flush()
+	}
+}
+
+func (o *prefixedOutput) writeLine(writer io.Writer, line []byte) error {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	_, err := writer.Write(line)
+	return err
+}
+
+// lineWriter buffers writes and writes them line by line with a prefix.
+type lineWriter struct {
+	Output *prefixedOutput
+	Writer io.Writer
+	Prefix string
+	Buffer []byte
+	Lock   sync.Mutex
+}
+
+func newLineWriter(output *prefixedOutput, writer io.Writer, prefix string) *lineWriter {
+	return &lineWriter{output, writer, prefix, nil, sync.Mutex{}}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.Buffer = append(w.Buffer, p...)
+	buffer := w.Buffer
+	for {
+		i := bytes.IndexByte(buffer, '\n')
+		if i < 0 && len(buffer) >= maxLineLength {
+			i = maxLineLength - 1
+		}
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(buffer[:i+1]); err != nil {
+			return 0, err
+		}
+		buffer = buffer[i+1:]
+	}
+	w.Buffer = append(w.Buffer[:0], buffer...)
+	return len(p), nil
+}
+
+// Flush writes any incomplete line.
+func (w *lineWriter) Flush() error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	if len(w.Buffer) == 0 {
+		return nil
+	}
+	err := w.writeLine(w.Buffer)
+	w.Buffer = w.Buffer[:0]
+	return err
+}
+
+// writeLine must be called with the lock held.
+func (w *lineWriter) writeLine(line []byte) error {
+	data := make([]byte, 0, len(w.Prefix)+len(line)+1)
+	data = append(data, w.Prefix...)
+	data = append(data, line...)
+	if data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return w.Output.writeLine(w.Writer, data)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixedOutput(t *testing.T) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	output := NewPrefixedOutput(stdout, stderr)
+	cmd := ExecCmd(exec.Command("foo"))
+	stdout0, stderr0 := output.Start(CmdInfo{Index: 0, ID: "0", Cmd: cmd})
+	stdout1, _ := output.Start(CmdInfo{Index: 1, ID: "1", Name: "one", Cmd: cmd})
+
+	write(t, stdout0, "hel")
+	write(t, stdout1, "foo\nb")
+	write(t, stderr0, "err\n")
+	write(t, stdout0, "lo\nwor")
+	write(t, stdout1, "ar\n")
+	assert.Equal(t, "[one] foo\n[0] hello\n[one] bar\n", stdout.String())
+	assert.Equal(t, "[0] err\n", stderr.String())
+
+	output.Finish(0, &CmdResult{})
+	output.Finish(1, &CmdResult{})
+	assert.Equal(t, "[one] foo\n[0] hello\n[one] bar\n[0] wor\n", stdout.String())
+}
+
+func TestPrefixedOutputLongLine(t *testing.T) {
+	stdout := bytes.NewBuffer(nil)
+	output := NewPrefixedOutput(stdout, stdout, WithPrefixFunc(CmdPrefix))
+	writer, _ := output.Start(CmdInfo{Index: 0, ID: "0", Cmd: ExecCmd(exec.Command("foo", "bar"))})
+	write(t, writer, strings.Repeat("a", maxLineLength+1))
+	output.Finish(0, &CmdResult{})
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "[foo bar] "+strings.Repeat("a", maxLineLength), lines[0])
+	assert.Equal(t, "[foo bar] a", lines[1])
+}
+
+func TestPrefixedOutputColor(t *testing.T) {
+	stdout := bytes.NewBuffer(nil)
+	output := NewPrefixedOutput(stdout, stdout, WithColor(), WithPrefixFunc(IndexPrefix))
+	writer, _ := output.Start(CmdInfo{Index: 1, ID: "b", Cmd: ExecCmd(exec.Command("foo"))})
+	write(t, writer, "foo\n")
+	assert.Equal(t, "\x1b[32m[1] \x1b[0mfoo\n", stdout.String())
+}
+
+func write(t *testing.T, writer io.Writer, s string) {
+	_, err := writer.Write([]byte(s))
+	require.NoError(t, err)
+}
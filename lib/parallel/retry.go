@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import "time"
+
+// RetryPolicy says how to retry commands that fail.
+//
+// Only commands that implement RetryableCmd are retried. Commands
+// that time out or are killed by the Runner are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times to run a command,
+	// including the first attempt.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry.
+	Backoff time.Duration
+	// BackoffMultiplier is what to multiply the backoff by after
+	// each retry. If less than or equal to 1, the backoff is fixed.
+	BackoffMultiplier float64
+	// MaxBackoff is the maximum backoff, or unlimited if 0.
+	MaxBackoff time.Duration
+	// ExitCodes are the exit codes to retry on. If empty, any
+	// failure is retried.
+	ExitCodes []int
+}
+
+// shouldRetry returns true if a command that failed on the given
+// attempt with the given exit code should be retried.
+func (p *RetryPolicy) shouldRetry(attempt int, exitCode int) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if len(p.ExitCodes) == 0 {
+		return true
+	}
+	for _, retryExitCode := range p.ExitCodes {
+		if exitCode == retryExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// getBackoff returns how long to wait after the given attempt
+// before the next attempt.
+func (p *RetryPolicy) getBackoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	if p.BackoffMultiplier > 1 {
+		for i := 1; i < attempt; i++ {
+			backoff = time.Duration(float64(backoff) * p.BackoffMultiplier)
+			if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+				break
+			}
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	retryPolicy := &RetryPolicy{
+		MaxAttempts:       5,
+		Backoff:           time.Second,
+		BackoffMultiplier: 2,
+		MaxBackoff:        5 * time.Second,
+		ExitCodes:         []int{2, 3},
+	}
+	assert.True(t, retryPolicy.shouldRetry(1, 2))
+	assert.True(t, retryPolicy.shouldRetry(4, 3))
+	assert.False(t, retryPolicy.shouldRetry(5, 2))
+	assert.False(t, retryPolicy.shouldRetry(1, 1))
+	assert.Equal(t, time.Second, retryPolicy.getBackoff(1))
+	assert.Equal(t, 2*time.Second, retryPolicy.getBackoff(2))
+	assert.Equal(t, 4*time.Second, retryPolicy.getBackoff(3))
+	assert.Equal(t, 5*time.Second, retryPolicy.getBackoff(4))
+	assert.Equal(t, 5*time.Second, retryPolicy.getBackoff(100))
+
+	retryPolicy = &RetryPolicy{MaxAttempts: 2, Backoff: time.Second}
+	assert.True(t, retryPolicy.shouldRetry(1, 1))
+	assert.Equal(t, time.Second, retryPolicy.getBackoff(3))
+
+	retryPolicy = nil
+	assert.False(t, retryPolicy.shouldRetry(1, 1))
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CmdResult is the result of a single command run by a Runner.
+type CmdResult struct {
+	// Cmd is the command.
+	Cmd Cmd
+	// ID is the ID of the Task of the command.
+	ID string
+	// Name is the name of the Task of the command, if any.
+	Name string
+	// Started is true if the command was started.
+	Started bool
+	// Killed is true if the command was killed by the Runner before
+	// it finished on its own.
+	Killed bool
+	// TimedOut is true if the command was killed because it
+	// exceeded its timeout or the timeout of the run.
+	TimedOut bool
+	// StoppedBy is the stage of termination that stopped the command
+	// if it was stopped by the Runner, either "signal" if it exited
+	// after being sent the stop signal, or "kill" if it was killed.
+	StoppedBy string
+	// Skipped is true if the command was never started because
+	// one of its dependencies did not succeed.
+	Skipped bool
+	// Attempts is the number of times the command was started.
+	Attempts int
+	// ExitCode is the exit code of the command, or -1 if the command
+	// was not started, was killed, or its exit code is not known.
+	ExitCode int
+	// Duration is how long the command ran for.
+	Duration time.Duration
+	// Err is the error the command finished with, if any.
+	Err error
+	// ResourceUsage is the resources used by all attempts of the
+	// command, or nil if the command does not implement
+	// ResourceUsageCmd or was killed before it exited.
+	ResourceUsage *ResourceUsage
+	// LimitExceeded is the limit the command was killed for
+	// exceeding, either "cpu_time" or "memory", if any.
+	LimitExceeded string
+}
+
+// String returns the name of the command, or the string
+// representation of the command if it has no name.
+func (r *CmdResult) String() string {
+	return getCmdName(r.Name, r.Cmd)
+}
+
+// PassedAfterRetry returns true if the command succeeded, but only
+// after being retried. The results of a run that succeeded are given
+// to the handler set with WithResultsHandler.
+func (r *CmdResult) PassedAfterRetry() bool {
+	return r.Started && !r.Killed && r.Err == nil && r.Attempts > 1
+}
+
+// RunError is the error returned by a Runner when a run fails.
+//
+// Err is the reason the run failed. If more than one reason applies,
+// an interrupt takes precedence over the run timing out or its context
+// being done, which takes precedence over a command timing out, which
+// takes precedence over a command failure.
+type RunError struct {
+	// Err is the reason the run failed.
+	Err error
+	// Results are the results of all commands, in the order they
+	// were given to the Runner.
+	Results []*CmdResult
+}
+
+// Error returns a string representation of the RunError.
+func (e *RunError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return e.Err.Error()
+	}
+	cmdStrings := make([]string, len(failed))
+	for i, result := range failed {
+		cmdStrings[i] = result.String()
+		if result.TimedOut {
+			cmdStrings[i] += " (timed out)"
+		}
+		if result.LimitExceeded != "" {
+			cmdStrings[i] += " (exceeded " + result.LimitExceeded + " limit)"
+		}
+	}
+	return fmt.Sprintf(
+		"%v: %d of %d commands failed: %s",
+		e.Err,
+		len(failed),
+		len(e.Results),
+		strings.Join(cmdStrings, ", "),
+	)
+}
+
+// Unwrap returns the reason the run failed.
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// TimedOut returns the results of the commands that timed out.
+func (e *RunError) TimedOut() []*CmdResult {
+	var timedOut []*CmdResult
+	for _, result := range e.Results {
+		if result.TimedOut {
+			timedOut = append(timedOut, result)
+		}
+	}
+	return timedOut
+}
+
+// Failed returns the results of the commands that finished with an error.
+func (e *RunError) Failed() []*CmdResult {
+	var failed []*CmdResult
+	for _, result := range e.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
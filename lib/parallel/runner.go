@@ -21,27 +21,103 @@
 package parallel
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"time"
 )
 
-var errInterrupted = errors.New("runner interrupted by signal")
+const (
+	stopReasonFastFail         = "fast_fail"
+	stopReasonFailureThreshold = "failure_threshold"
+	stopReasonInterrupted      = "interrupted"
+	stopReasonRunTimedOut      = "run_timed_out"
+	stopReasonContextDone      = "context_done"
+)
+
+var (
+	errInterrupted = errors.New("runner interrupted by signal")
+	errRunTimedOut = errors.New("runner timed out")
+)
+
+// contextError is returned when the context given to RunContext is done.
+type contextError struct {
+	err error
+}
+
+func newContextError(err error) *contextError {
+	return &contextError{err}
+}
+
+func (e *contextError) Error() string {
+	return "runner context done: " + e.err.Error()
+}
+
+// Unwrap returns the underlying context error.
+func (e *contextError) Unwrap() error {
+	return e.err
+}
 
 type runner struct {
-	FastFail          bool
-	MaxConcurrentCmds int
-	EventHandler      func(*Event)
-	Clock             func() time.Time
+	FastFail            bool
+	FailureThreshold    *FailureThreshold
+	MaxConcurrentCmds   int
+	AdaptiveConcurrency *AdaptiveConcurrency
+	// ReadSystemLoad reads the load of the system for
+	// AdaptiveConcurrency.
+	ReadSystemLoad  func() (*systemLoad, error)
+	MaxQueuedCmds   int
+	StartRate       *StartRate
+	CmdTimeout      time.Duration
+	RunTimeout      time.Duration
+	StopSignal      os.Signal
+	StopGracePeriod time.Duration
+	// Signals are the signals that interrupt a run, or empty if
+	// the runner does not handle signals.
+	Signals []os.Signal
+	// ForwardSignals is whether the signal that interrupted a run
+	// is sent to the running commands instead of the stop signal.
+	ForwardSignals     bool
+	ForwardGracePeriod time.Duration
+	ChildSubreaper     bool
+	RetryPolicy        *RetryPolicy
+	ResourcePools      map[string]int
+	SchedulingOrder    SchedulingOrder
+	Output             Output
+	EventHandler       func(*Event)
+	// ResultsHandler is given the results of every run, or is nil.
+	ResultsHandler func([]*CmdResult)
+	Clock          func() time.Time
 }
 
 func newRunner(options ...RunnerOption) *runner {
 	runner := &runner{
 		DefaultFastFail,
+		nil,
 		DefaultMaxConcurrentCmds,
+		nil,
+		readSystemLoad,
+		DefaultMaxQueuedCmds,
+		nil,
+		0,
+		0,
+		nil,
+		0,
+		DefaultSignals,
+		false,
+		0,
+		false,
+		nil,
+		nil,
+		SubmissionOrder,
+		nil,
 		DefaultEventHandler,
+		nil,
 		DefaultClock,
 	}
 	for _, option := range options {
@@ -51,61 +127,327 @@ func newRunner(options ...RunnerOption) *runner {
 }
 
 func (r *runner) Run(cmds []Cmd) error {
-	// there is a race condition where err could be set to
-	// errCmdFailed or not set at all even after an interrupt happens
-	var err error
-	doneC := make(chan struct{})
-	cmdControllers := make([]*cmdController, len(cmds))
-	for i, cmd := range cmds {
-		cmdControllers[i] = newCmdController(cmd, r.EventHandler, r.Clock)
-	}
-
-	signalC := make(chan os.Signal, 1)
-	signal.Notify(signalC, os.Interrupt)
-	go func() {
-		for range signalC {
-			// do not want to acquire lock in the signal handler
-			err = errInterrupted
-			doneC <- struct{}{}
-			return
-		}
-	}()
+	return r.RunContext(context.Background(), cmds)
+}
 
-	var wg sync.WaitGroup
-	semaphore := newSemaphore(r.MaxConcurrentCmds)
+func (r *runner) RunContext(ctx context.Context, cmds []Cmd) error {
+	return r.run(ctx, cmdsToTasks(cmds), make([][]int, len(cmds)))
+}
 
-	startTime := r.Clock()
-	r.EventHandler(newStartedEvent(startTime))
-	for _, cmdController := range cmdControllers {
-		cmdController := cmdController
-		wg.Add(1)
+func (r *runner) RunTasks(ctx context.Context, tasks []*Task) error {
+	dependencies, err := getTaskDependencies(tasks)
+	if err != nil {
+		return err
+	}
+	if err := validateTaskResources(tasks, r.ResourcePools); err != nil {
+		return err
+	}
+	return r.run(ctx, tasks, dependencies)
+}
+
+// run runs the tasks, where dependencies contains the indexes
+// of the dependencies of each task.
+func (r *runner) run(ctx context.Context, tasks []*Task, dependencies [][]int) error {
+	order, ranks, err := getTaskOrder(tasks, r.SchedulingOrder)
+	if err != nil {
+		return err
+	}
+	activeRun, err := r.start(ctx, tasks, dependencies, order, ranks, true)
+	if err != nil {
+		return err
+	}
+	return activeRun.Wait()
+}
+
+// start starts a run of the tasks. If closed is false, more tasks
+// can be added to the scheduler of the run until it is closed.
+func (r *runner) start(
+	ctx context.Context,
+	tasks []*Task,
+	dependencies [][]int,
+	order []int,
+	ranks []int,
+	closed bool,
+) (*activeRun, error) {
+	if r.FailureThreshold != nil {
+		if err := validateFailureThreshold(r.FailureThreshold); err != nil {
+			return nil, err
+		}
+	}
+	if r.AdaptiveConcurrency != nil {
+		if err := validateAdaptiveConcurrency(r.AdaptiveConcurrency); err != nil {
+			return nil, err
+		}
+	}
+	if r.StartRate != nil {
+		if err := validateStartRate(r.StartRate); err != nil {
+			return nil, err
+		}
+	}
+	if r.ChildSubreaper {
+		if err := setChildSubreaper(); err != nil {
+			return nil, err
+		}
+	}
+	// the run uses a copy of the runner whose EventHandler sets
+	// the run ID on every Event
+	runID := newRunID()
+	eventHandler := r.EventHandler
+	runRunner := *r
+	runRunner.EventHandler = func(event *Event) {
+		event.RunID = runID
+		eventHandler(event)
+	}
+	if r.AdaptiveConcurrency != nil {
+		// the scheduler has enough workers and slots for the
+		// highest concurrency, and the semaphore limits them
+		runRunner.MaxConcurrentCmds = r.AdaptiveConcurrency.MaxConcurrentCmds
+	}
+	r = &runRunner
+	ctx, cancel := context.WithCancel(ctx)
+	state := newRunState()
+
+	var signalC chan os.Signal
+	if len(r.Signals) > 0 {
+		signalC = make(chan os.Signal, 1)
+		signal.Notify(signalC, r.Signals...)
 		go func() {
-			semaphore.P(1)
-			defer semaphore.V(1)
-			defer wg.Done()
-			if !cmdController.Run() {
-				// best effort to prioritize the interrupt error
-				// but this is not deterministic
-				err = errCmdFailed
-				if r.FastFail {
-					doneC <- struct{}{}
-				}
+			select {
+			case sig := <-signalC:
+				state.Interrupt(sig)
+			case <-state.DoneC:
 			}
 		}()
 	}
-	go func() {
-		// if everything finishes and there is an interrupt, we could
-		// end up not actually returning an error if everything below
-		// completes before we context switch to the interrupt goroutine
-		wg.Wait()
-		doneC <- struct{}{}
-	}()
-	// this waits on command completion, fast failure, or signal
-	<-doneC
-	for _, cmdController := range cmdControllers {
-		cmdController.Kill()
-	}
-	finishTime := r.Clock()
-	r.EventHandler(newFinishedEvent(finishTime, startTime, err))
+
+	var runTimer *time.Timer
+	if r.RunTimeout > 0 {
+		runTimer = time.NewTimer(r.RunTimeout)
+	}
+	scheduler := newScheduler(r, ctx, state, tasks, dependencies, order, ranks, closed)
+	startTime := r.Clock()
+	r.EventHandler(newStartedEvent(startTime))
+	if r.AdaptiveConcurrency != nil {
+		limit := getInitialConcurrency(r.AdaptiveConcurrency)
+		scheduler.Semaphore.SetLimit(limit)
+		go r.adaptConcurrency(scheduler.Semaphore, limit, state.DoneC)
+	}
+	scheduler.Start()
+	return &activeRun{r, ctx, cancel, state, scheduler, runTimer, signalC, startTime}, nil
+}
+
+// activeRun is a run that was started.
+type activeRun struct {
+	Runner    *runner
+	Ctx       context.Context
+	Cancel    context.CancelFunc
+	State     *runState
+	Scheduler *scheduler
+	// RunTimer fires when the run times out, or is nil if
+	// there is no run timeout.
+	RunTimer *time.Timer
+	// SignalC receives the signals that interrupt the run, or is
+	// nil if the runner does not handle signals.
+	SignalC   chan os.Signal
+	StartTime time.Time
+}
+
+// Wait waits for the run to be done, stops all remaining commands,
+// and returns the error of the run. Must only be called once.
+func (a *activeRun) Wait() error {
+	defer a.Cancel()
+	if a.SignalC != nil {
+		defer signal.Stop(a.SignalC)
+	}
+	var runTimeoutC <-chan time.Time
+	if a.RunTimer != nil {
+		defer a.RunTimer.Stop()
+		runTimeoutC = a.RunTimer.C
+	}
+	// this waits on command completion, fast failure, signal,
+	// the run timing out, or the context being done
+	select {
+	case <-a.State.DoneC:
+	case <-runTimeoutC:
+		a.State.SetErr(errRunTimedOut)
+		a.State.Stop(stopReasonRunTimedOut)
+	case <-a.Ctx.Done():
+		a.State.SetErr(newContextError(a.Ctx.Err()))
+		a.State.Stop(stopReasonContextDone)
+	}
+	a.State.Done()
+	killErr := a.State.KillReason()
+	var forwardedSignal os.Signal
+	if a.Runner.ForwardSignals {
+		forwardedSignal = a.State.GetSignal()
+	}
+	a.Scheduler.Kill(killErr, forwardedSignal)
+	results := a.Scheduler.Results(killErr)
+	if a.Runner.ChildSubreaper {
+		cmds := make([]Cmd, len(results))
+		for i, result := range results {
+			cmds[i] = result.Cmd
+		}
+		a.Runner.reapOrphans(cmds, a.Scheduler.Pgids())
+	}
+	if a.Runner.ResultsHandler != nil {
+		a.Runner.ResultsHandler(results)
+	}
+	err := a.State.RunError(results)
+	finishTime := a.Runner.Clock()
+	a.Runner.EventHandler(newFinishedEvent(finishTime, a.StartTime, a.State.GetStopReason(), err))
 	return err
 }
+
+func (r *runner) getCmdConfig(index int, task *Task) cmdConfig {
+	config := cmdConfig{
+		Index:              index,
+		ID:                 task.ID,
+		Name:               task.Name,
+		Timeout:            r.CmdTimeout,
+		StopSignal:         r.StopSignal,
+		StopGracePeriod:    r.StopGracePeriod,
+		ForwardGracePeriod: r.ForwardGracePeriod,
+		RetryPolicy:        r.RetryPolicy,
+		Output:             r.Output,
+	}
+	if task.Timeout > 0 {
+		config.Timeout = task.Timeout
+	}
+	if task.RetryPolicy != nil {
+		config.RetryPolicy = task.RetryPolicy
+	}
+	return config
+}
+
+// runState is the state of a single run that is shared between
+// the goroutines of the run.
+type runState struct {
+	DoneC    chan struct{}
+	DoneOnce sync.Once
+	Err      error
+	// StopReason is why the run was stopped before all its
+	// commands finished, or empty if it was not.
+	StopReason string
+	// Signal is the signal that interrupted the run, if any.
+	Signal os.Signal
+	Lock   sync.Mutex
+}
+
+func newRunState() *runState {
+	return &runState{make(chan struct{}), sync.Once{}, nil, "", nil, sync.Mutex{}}
+}
+
+// SetErr sets the error of the run if it takes precedence over
+// the current error.
+func (s *runState) SetErr(err error) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if getErrPriority(err) > getErrPriority(s.Err) {
+		s.Err = err
+	}
+}
+
+// Done signals that the run should stop.
+func (s *runState) Done() {
+	s.Stop("")
+}
+
+// Stop signals that the run should stop for the given reason, which
+// is only recorded if the run was not done yet.
+func (s *runState) Stop(reason string) {
+	s.DoneOnce.Do(func() {
+		s.Lock.Lock()
+		s.StopReason = reason
+		s.Lock.Unlock()
+		close(s.DoneC)
+	})
+}
+
+// Interrupt stops the run because the signal was received.
+func (s *runState) Interrupt(sig os.Signal) {
+	s.Lock.Lock()
+	if s.Signal == nil {
+		s.Signal = sig
+	}
+	s.Lock.Unlock()
+	s.SetErr(errInterrupted)
+	s.Stop(stopReasonInterrupted)
+}
+
+// GetSignal returns the signal that interrupted the run, or nil
+// if it was not interrupted.
+func (s *runState) GetSignal() os.Signal {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.Signal
+}
+
+// GetStopReason returns why the run was stopped before all its
+// commands finished, or empty if it was not.
+func (s *runState) GetStopReason() string {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.StopReason
+}
+
+// KillReason returns the reason to give to commands that are still
+// running when the run stops, or nil if there is no reason.
+func (s *runState) KillReason() error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if getErrPriority(s.Err) > getErrPriority(errCmdTimedOut) {
+		return s.Err
+	}
+	return nil
+}
+
+// RunError returns a *RunError for the given results, or nil
+// if the run did not fail.
+func (s *runState) RunError(results []*CmdResult) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.Err == nil {
+		return nil
+	}
+	return &RunError{s.Err, results}
+}
+
+// newRunID returns a new random ID for a run.
+func newRunID() string {
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(data)
+}
+
+func getErrPriority(err error) int {
+	switch err.(type) {
+	case nil:
+		return 0
+	case *contextError:
+		return 3
+	}
+	switch err {
+	case errInterrupted:
+		return 4
+	case errRunTimedOut:
+		return 3
+	case errCmdTimedOut:
+		return 2
+	case errCmdFailed:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// isTimeoutErr returns true if commands killed for the given
+// reason should be considered timed out.
+func isTimeoutErr(err error) bool {
+	if contextErr, ok := err.(*contextError); ok {
+		return contextErr.err == context.DeadlineExceeded
+	}
+	return err == errRunTimedOut
+}
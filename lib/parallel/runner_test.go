@@ -23,12 +23,20 @@ package parallel
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -60,16 +68,574 @@ func TestError(t *testing.T) {
 		newSimpleCmd(0, "5", 0),
 	}
 	testEnv := newTestEnv(5, cmds)
-	require.Error(t, testEnv.run())
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	runErr := err.(*RunError)
+	require.Equal(t, errCmdFailed, runErr.Err)
+	require.Len(t, runErr.Results, 5)
+	failed := runErr.Failed()
+	require.Len(t, failed, 1)
+	require.Equal(t, 1, failed[0].ExitCode)
+	require.Equal(t, 0, runErr.Results[0].ExitCode)
 
 	testEnv.eventHandler.StartedEventSuccess(t)
-	testEnv.eventHandler.FinishedEventError(t)
+	require.NotContains(t, testEnv.eventHandler.FinishedEventError(t).Fields, "stop_reason")
 	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdStarted, 5)
 	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 4)
 	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 1)
 	require.Equal(t, []string{"1", "2", "3", "4", "5"}, testEnv.stdout.SortedLines(t))
 }
 
+func TestFailureThreshold(t *testing.T) {
+	tests := []struct {
+		name             string
+		failureThreshold FailureThreshold
+		exitCodes        []int
+		numStarted       int
+	}{
+		{
+			name:             "failures",
+			failureThreshold: FailureThreshold{Failures: 2},
+			exitCodes:        []int{1, 0, 1, 0, 1, 0},
+			numStarted:       3,
+		},
+		{
+			name:             "percent",
+			failureThreshold: FailureThreshold{Percent: 25},
+			exitCodes:        []int{1, 0, 0, 1, 1, 0, 0, 0},
+			numStarted:       5,
+		},
+		{
+			name:             "not reached",
+			failureThreshold: FailureThreshold{Failures: 3, Percent: 50},
+			exitCodes:        []int{1, 0, 1, 0},
+			numStarted:       4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmds []*exec.Cmd
+			for i, exitCode := range tt.exitCodes {
+				cmds = append(cmds, newSimpleCmd(0, strconv.Itoa(i), exitCode))
+			}
+			testEnv := newTestEnv(1, cmds, WithFailureThreshold(tt.failureThreshold))
+			err := testEnv.run()
+			require.Error(t, err)
+			require.Equal(t, errCmdFailed, err.(*RunError).Err)
+
+			testEnv.eventHandler.NumEventsForType(t, EventTypeCmdStarted, tt.numStarted)
+			finishedEvent := testEnv.eventHandler.FinishedEventError(t)
+			if tt.numStarted < len(cmds) {
+				require.Equal(t, "failure_threshold", finishedEvent.Fields["stop_reason"])
+			} else {
+				require.NotContains(t, finishedEvent.Fields, "stop_reason")
+			}
+		})
+	}
+}
+
+func TestCmdTimeout(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(2, "2", 0),
+		newSimpleCmd(0, "3", 1),
+	}
+	testEnv := newTestEnv(3, cmds, WithCmdTimeout(500*time.Millisecond))
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	runErr := err.(*RunError)
+	require.Equal(t, errCmdTimedOut, runErr.Err)
+	require.Len(t, runErr.Failed(), 2)
+	timedOut := runErr.TimedOut()
+	require.Len(t, timedOut, 1)
+	require.Equal(t, ExecCmd(cmds[1]).String(), timedOut[0].Cmd.String())
+	require.Contains(t, runErr.Error(), "(timed out)")
+
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdTimedOut, 1)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 1)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+}
+
+func TestRunTimeout(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(5, "2", 0),
+		newSimpleCmd(5, "3", 0),
+	}
+	testEnv := newTestEnv(3, cmds, WithRunTimeout(500*time.Millisecond))
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	runErr := err.(*RunError)
+	require.Equal(t, errRunTimedOut, runErr.Err)
+	require.Len(t, runErr.TimedOut(), 2)
+	require.Equal(t, "run_timed_out", testEnv.eventHandler.FinishedEventError(t).Fields["stop_reason"])
+
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdTimedOut, 2)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 1)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+}
+
+func TestGracefulTermination(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newTrapCmd(5, false),
+		newTrapCmd(5, true),
+	}
+	testEnv := newTestEnv(
+		2,
+		cmds,
+		WithRunTimeout(500*time.Millisecond),
+		WithGracefulTermination(syscall.SIGTERM, time.Second),
+	)
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.Equal(t, stopStageSignal, results[0].StoppedBy)
+	require.Equal(t, stopStageKill, results[1].StoppedBy)
+
+	var stoppedBy []string
+	for _, event := range testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2) {
+		stoppedBy = append(stoppedBy, event.Fields["stopped_by"].(string))
+	}
+	require.ElementsMatch(t, []string{stopStageSignal, stopStageKill}, stoppedBy)
+	require.Equal(t, []string{"terminated"}, testEnv.stdout.Lines(t))
+}
+
+func TestSignals(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(5, "2", 0),
+	}
+	testEnv := newTestEnv(2, cmds, WithSignals(syscall.SIGHUP))
+	signalAfter(t, syscall.SIGHUP, 500*time.Millisecond)
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	runErr := err.(*RunError)
+	require.Equal(t, errInterrupted, runErr.Err)
+	require.True(t, runErr.Results[1].Killed)
+	require.Equal(t, stopStageKill, runErr.Results[1].StoppedBy)
+	require.Equal(t, "interrupted", testEnv.eventHandler.FinishedEventError(t).Fields["stop_reason"])
+}
+
+func TestSignalForwarding(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newTrapCmd(5, false),
+		newTrapCmd(5, true),
+	}
+	testEnv := newTestEnv(
+		2,
+		cmds,
+		WithSignals(syscall.SIGTERM),
+		WithSignalForwarding(time.Second),
+	)
+	signalAfter(t, syscall.SIGTERM, 500*time.Millisecond)
+	err := testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.Equal(t, errInterrupted, err.(*RunError).Err)
+	require.Equal(t, stopStageSignal, results[0].StoppedBy)
+	require.Equal(t, stopStageKill, results[1].StoppedBy)
+	require.Equal(t, []string{"terminated"}, testEnv.stdout.Lines(t))
+}
+
+func TestWithoutSignalHandling(t *testing.T) {
+	runner := newRunner(WithoutSignalHandling())
+	require.Empty(t, runner.Signals)
+	runnerPool, err := runner.Start(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, runnerPool.(*pool).ActiveRun.SignalC)
+	runnerPool.Close()
+	require.NoError(t, runnerPool.Wait())
+}
+
+func TestProcessGroup(t *testing.T) {
+	// the sleep is a child of the shell, and would keep stdout open
+	// for 5 seconds if only the shell was killed
+	cmds := []*exec.Cmd{
+		newSimpleCmd(5, "1", 0),
+	}
+	testEnv := newTestEnv(1, cmds, WithCmdTimeout(200*time.Millisecond))
+	testEnv.execCmdOptions = []ExecCmdOption{WithProcessGroup()}
+	start := time.Now()
+	require.Error(t, testEnv.run())
+	require.True(t, time.Since(start) < 3*time.Second)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdTimedOut, 1)
+}
+
+func TestChildSubreaper(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("child subreaper is only supported on Linux")
+	}
+	// a child of the process that is not a command of the run
+	otherCmd := exec.Command("sleep", "5")
+	require.NoError(t, otherCmd.Start())
+	cmds := []*exec.Cmd{
+		exec.Command("./testdata/bin/orphan.sh", "5", "1"),
+	}
+	testEnv := newTestEnv(1, cmds, WithChildSubreaper())
+	testEnv.execCmdOptions = []ExecCmdOption{WithProcessGroup()}
+	require.NoError(t, testEnv.run())
+	var orphanCmds []string
+	for _, event := range testEnv.eventHandler.EventsForTypeSuccess(EventTypeOrphanReaped) {
+		orphanCmds = append(orphanCmds, event.Fields["cmd"].(string))
+	}
+	require.Equal(t, []string{"sleep 5"}, orphanCmds)
+	require.Equal(t, []string{"1"}, testEnv.stdout.Lines(t))
+
+	// the other child keeps running, and can still be waited for
+	require.NoError(t, otherCmd.Process.Kill())
+	err := otherCmd.Wait()
+	require.IsType(t, &exec.ExitError{}, err)
+	require.Equal(t, "signal: killed", err.Error())
+}
+
+func TestChildSubreaperNotStarted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("child subreaper is only supported on Linux")
+	}
+	cmds := []*exec.Cmd{
+		exec.Command("./testdata/bin/orphan.sh", "5", "1"),
+		newSimpleCmd(0, "2", 1),
+		newSimpleCmd(0, "3", 0),
+	}
+	testEnv := newTestEnv(1, cmds, WithChildSubreaper(), WithFastFail())
+	testEnv.execCmdOptions = []ExecCmdOption{WithProcessGroup()}
+	err := testEnv.run()
+	require.Error(t, err)
+	results := err.(*RunError).Results
+	require.False(t, results[2].Started)
+	orphanReapedEvent := testEnv.eventHandler.OneEventForTypeSuccess(t, EventTypeOrphanReaped)
+	require.Equal(t, "sleep 5", orphanReapedEvent.Fields["cmd"])
+	testEnv.eventHandler.OneEventForType(t, EventTypeCmdKilled)
+}
+
+func TestRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "parallel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	cmds := []*exec.Cmd{
+		newFlakyCmd(filepath.Join(tmpDir, "1"), "1", 2),
+		newSimpleCmd(0, "2", 2),
+		newSimpleCmd(0, "3", 1),
+		newSimpleCmd(0, "4", 0),
+	}
+	testEnv := newTestEnv(4, cmds, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		ExitCodes:   []int{2},
+	}))
+	err = testEnv.run()
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.True(t, results[0].PassedAfterRetry())
+	require.Equal(t, 2, results[0].Attempts)
+	require.Equal(t, 3, results[1].Attempts)
+	require.Equal(t, 2, results[1].ExitCode)
+	require.Equal(t, 1, results[2].Attempts)
+	require.False(t, results[3].PassedAfterRetry())
+	require.Equal(t, 1, results[3].Attempts)
+
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdRetried, 3)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdStarted, 4)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 2)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+	require.Equal(t, []string{"1", "2", "2", "2", "3", "4"}, testEnv.stdout.SortedLines(t))
+}
+
+func TestResultsHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "parallel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	cmds := []*exec.Cmd{
+		newFlakyCmd(filepath.Join(tmpDir, "1"), "1", 2),
+		newSimpleCmd(0, "2", 0),
+	}
+	var results []*CmdResult
+	testEnv := newTestEnv(
+		2,
+		cmds,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond}),
+		WithResultsHandler(func(runResults []*CmdResult) { results = runResults }),
+	)
+	require.NoError(t, testEnv.run())
+	require.Len(t, results, 2)
+	require.True(t, results[0].PassedAfterRetry())
+	require.False(t, results[1].PassedAfterRetry())
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	eventHandler := newTestEventHandler()
+	runner := newRunner(
+		WithEventHandler(eventHandler.Handle),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Second}),
+	)
+	err := runner.Run([]Cmd{newTestNopCmd("nop", nil, errors.New("boom"))})
+	require.Error(t, err)
+	results := err.(*RunError).Results
+	require.Equal(t, 1, results[0].Attempts)
+	require.Contains(t, results[0].Err.Error(), "boom")
+
+	eventHandler.NumEventsForType(t, EventTypeCmdRetried, 0)
+	require.Contains(t, eventHandler.OneEventForTypeError(t, EventTypeCmdFinished).Error, "boom")
+}
+
+func TestPrefixedOutputRunner(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	stdout := newConcurrentReadWriter()
+	testEnv := newTestEnv(3, cmds, WithOutput(NewPrefixedOutput(stdout, stdout)))
+	require.NoError(t, testEnv.run())
+	require.Empty(t, testEnv.stdout.Lines(t))
+	require.Equal(t, []string{"[0] 1", "[1] 2", "[2] 3"}, stdout.SortedLines(t))
+}
+
+func TestGroupedOutputRunner(t *testing.T) {
+	cmds := []*exec.Cmd{
+		exec.Command("sh", "-c", "echo partial; sleep 5"),
+		newSimpleCmd(1, "1", 1),
+	}
+	stdout := newConcurrentReadWriter()
+	testEnv := newTestEnv(2, cmds, WithFastFail(), WithOutput(NewGroupedOutput(stdout)))
+	testEnv.execCmdOptions = []ExecCmdOption{WithProcessGroup()}
+	require.Error(t, testEnv.run())
+	lines := stdout.Lines(t)
+	require.Len(t, lines, 4)
+	require.Contains(t, lines[0], "(failed with exit code 1 in ")
+	require.Equal(t, "1", lines[1])
+	require.Contains(t, lines[2], "(killed in ")
+	require.Equal(t, "partial", lines[3])
+}
+
+func TestTasks(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(1, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	testEnv := newTestEnv(3, cmds)
+	require.NoError(t, testEnv.runTasks(
+		[]string{"c"},
+		nil,
+		[]string{"b"},
+	))
+
+	testEnv.eventHandler.StartedEventSuccess(t)
+	testEnv.eventHandler.FinishedEventSuccess(t)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 3)
+	testEnv.eventHandler.NumEventsForType(t, EventTypeCmdSkipped, 0)
+	require.Equal(t, []string{"2", "3", "1"}, testEnv.stdout.Lines(t))
+}
+
+func TestTasksSkipped(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 1),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+		newSimpleCmd(0, "4", 0),
+	}
+	testEnv := newTestEnv(4, cmds)
+	err := testEnv.runTasks(
+		nil,
+		[]string{"a"},
+		[]string{"b"},
+		nil,
+	)
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.False(t, results[0].Skipped)
+	require.True(t, results[1].Skipped)
+	require.True(t, results[2].Skipped)
+	require.False(t, results[3].Skipped)
+
+	testEnv.eventHandler.FinishedEventError(t)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 1)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 1)
+	testEnv.eventHandler.NumEventsForType(t, EventTypeCmdSkipped, 2)
+	require.Equal(t, []string{"1", "4"}, testEnv.stdout.SortedLines(t))
+}
+
+func TestTaskNames(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 1),
+		newSimpleCmd(0, "1", 1),
+	}
+	stdout := newConcurrentReadWriter()
+	testEnv := newTestEnv(2, cmds, WithOutput(NewPrefixedOutput(stdout, stdout)))
+	tasks := []*Task{
+		{ID: "a", Name: "first", Cmd: ExecCmd(cmds[0])},
+		{ID: "b", Cmd: ExecCmd(cmds[1])},
+	}
+	err := testEnv.runner.RunTasks(context.Background(), tasks)
+	require.EqualError(t, err, "command failed: 2 of 2 commands failed: first, "+ExecCmd(cmds[1]).String())
+	results := err.(*RunError).Results
+	require.Equal(t, "a", results[0].ID)
+	require.Equal(t, "first", results[0].Name)
+	require.Equal(t, "b", results[1].ID)
+	require.Empty(t, results[1].Name)
+
+	finishedEvents := testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+	names := make(map[string]string)
+	for _, event := range finishedEvents {
+		names[event.Cmd.ID] = event.Cmd.Name
+	}
+	require.Equal(t, map[string]string{"a": "first", "b": ExecCmd(cmds[1]).String()}, names)
+	require.Equal(t, []string{"[b] 1", "[first] 1"}, stdout.SortedLines(t))
+}
+
+func TestResourcePool(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(1, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	testEnv := newTestEnv(3, cmds, WithResourcePool("db", 1))
+	tasks := []*Task{
+		{ID: "a", Cmd: ExecCmd(cmds[0]), Resources: []string{"db"}},
+		{ID: "b", Cmd: ExecCmd(cmds[1]), DependsOn: []string{"c"}, Resources: []string{"db"}},
+		{ID: "c", Cmd: ExecCmd(cmds[2]), Weight: 2},
+	}
+	require.NoError(t, testEnv.runner.RunTasks(context.Background(), tasks))
+
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 3)
+	// b waits for a to release db even though there are free slots
+	require.Equal(t, []string{"3", "1", "2"}, testEnv.stdout.Lines(t))
+}
+
+func TestSchedulingOrder(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	durationHistory := NewDurationHistory()
+	durationHistory.Record(ExecCmd(cmds[1]).String(), time.Second)
+	durationHistory.Record(ExecCmd(cmds[2]).String(), 2*time.Second)
+	testEnv := newTestEnv(1, cmds, WithSchedulingOrder(LongestFirst(durationHistory)))
+	require.NoError(t, testEnv.run())
+
+	require.Equal(t, []string{"1", "3", "2"}, testEnv.stdout.Lines(t))
+}
+
+func TestErrPriority(t *testing.T) {
+	state := newRunState()
+	state.SetErr(errCmdFailed)
+	require.Nil(t, state.KillReason())
+	state.SetErr(errCmdTimedOut)
+	require.Nil(t, state.KillReason())
+	state.SetErr(errRunTimedOut)
+	require.Equal(t, errRunTimedOut, state.KillReason())
+	state.SetErr(errInterrupted)
+	state.SetErr(newContextError(context.Canceled))
+	state.SetErr(errCmdFailed)
+	require.Equal(t, errInterrupted, state.KillReason())
+	err := state.RunError(nil)
+	require.IsType(t, &RunError{}, err)
+	require.Equal(t, errInterrupted, err.(*RunError).Err)
+}
+
+func TestContextCancel(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(5, "1", 0),
+		newSimpleCmd(5, "2", 0),
+		newSimpleCmd(5, "3", 0),
+	}
+	testEnv := newTestEnv(2, cmds)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := testEnv.runContext(ctx)
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	runErr := err.(*RunError)
+	require.IsType(t, &contextError{}, runErr.Err)
+	require.Equal(t, context.DeadlineExceeded, runErr.Err.(*contextError).Unwrap())
+	require.Len(t, runErr.Results, 3)
+	var numKilled, numNotStarted int
+	for _, result := range runErr.Results {
+		if result.Killed {
+			numKilled++
+		}
+		if !result.Started {
+			numNotStarted++
+		}
+	}
+	require.Equal(t, 2, numKilled)
+	require.Equal(t, 1, numNotStarted)
+
+	testEnv.eventHandler.StartedEventSuccess(t)
+	testEnv.eventHandler.FinishedEventError(t)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdStarted, 2)
+	testEnv.eventHandler.NumEventsForTypeError(t, EventTypeCmdFinished, 2)
+	killedEvent := testEnv.eventHandler.OneEventForTypeSuccess(t, EventTypeCmdKilled)
+	require.Equal(t, "runner context done: context deadline exceeded", killedEvent.Fields["reason"])
+}
+
+func TestFastFailKilled(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 1),
+		newSimpleCmd(0, "3", 0),
+		newSimpleCmd(0, "4", 0),
+	}
+	testEnv := newTestEnv(1, cmds, WithFastFail())
+	err := testEnv.runTasks(nil, nil, []string{"a"}, []string{"b"})
+	require.Error(t, err)
+
+	require.Equal(t, "fast_fail", testEnv.eventHandler.FinishedEventError(t).Fields["stop_reason"])
+	testEnv.eventHandler.NumEventsForType(t, EventTypeCmdFinished, 2)
+	testEnv.eventHandler.NumEventsForType(t, EventTypeCmdSkipped, 0)
+	// the dependent of the failed command is killed with the others
+	// since the run is done before it finishes
+	var killedIDs []string
+	for _, event := range testEnv.eventHandler.NumEventsForType(t, EventTypeCmdKilled, 2) {
+		killedIDs = append(killedIDs, event.Cmd.ID)
+		require.Equal(t, errCmdNotStarted.Error(), event.Fields["reason"])
+	}
+	require.ElementsMatch(t, []string{"c", "d"}, killedIDs)
+}
+
+func TestTerminalEvents(t *testing.T) {
+	exitCodes := []int{0, 1, 0, 0, 0, 0, 0, 0}
+	var cmds []*exec.Cmd
+	for i, exitCode := range exitCodes {
+		cmds = append(cmds, newSimpleCmd(0, strconv.Itoa(i), exitCode))
+	}
+	testEnv := newTestEnv(2, cmds, WithFastFail())
+	err := testEnv.runTasks(
+		nil,
+		nil,
+		[]string{"a"},
+		[]string{"b"},
+		[]string{"c"},
+		[]string{"d", "e"},
+		nil,
+		[]string{"g"},
+	)
+	require.Error(t, err)
+
+	terminalEvents := make(map[string]int)
+	for _, eventType := range []EventType{EventTypeCmdFinished, EventTypeCmdSkipped, EventTypeCmdKilled} {
+		for _, event := range testEnv.eventHandler.EventsForType(eventType) {
+			terminalEvents[event.Cmd.ID]++
+		}
+	}
+	require.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1, "g": 1, "h": 1}, terminalEvents)
+	// no Event is sent after the run finished
+	testEnv.eventHandler.lock.RLock()
+	defer testEnv.eventHandler.lock.RUnlock()
+	events := testEnv.eventHandler.events
+	require.Equal(t, EventTypeFinished, events[len(events)-1].Type)
+}
+
 func newSimpleCmd(sleepSec int, echoString string, exitCode int) *exec.Cmd {
 	return exec.Command(
 		"./testdata/bin/simple.sh",
@@ -79,16 +645,47 @@ func newSimpleCmd(sleepSec int, echoString string, exitCode int) *exec.Cmd {
 	)
 }
 
+func newFlakyCmd(filePath string, echoString string, exitCode int) *exec.Cmd {
+	return exec.Command(
+		"./testdata/bin/flaky.sh",
+		filePath,
+		echoString,
+		strconv.Itoa(exitCode),
+	)
+}
+
+// signalAfter sends sig to the test process after delay.
+func signalAfter(t *testing.T, sig os.Signal, delay time.Duration) {
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	time.AfterFunc(delay, func() {
+		_ = process.Signal(sig)
+	})
+}
+
+func newTrapCmd(sleepSec int, ignore bool) *exec.Cmd {
+	mode := "exit"
+	if ignore {
+		mode = "ignore"
+	}
+	return exec.Command(
+		"./testdata/bin/trap.sh",
+		strconv.Itoa(sleepSec),
+		mode,
+	)
+}
+
 type testEnv struct {
 	maxConcurrentCmds int
 	cmds              []*exec.Cmd
+	execCmdOptions    []ExecCmdOption
 	runner            *runner
 	eventHandler      *testEventHandler
 	stdout            *testBuffer
 	stderr            *testBuffer
 }
 
-func newTestEnv(maxConcurrentCmds int, cmds []*exec.Cmd) *testEnv {
+func newTestEnv(maxConcurrentCmds int, cmds []*exec.Cmd, options ...RunnerOption) *testEnv {
 	stdout := newConcurrentReadWriter()
 	stderr := newConcurrentReadWriter()
 	for _, cmd := range cmds {
@@ -99,9 +696,15 @@ func newTestEnv(maxConcurrentCmds int, cmds []*exec.Cmd) *testEnv {
 	return &testEnv{
 		maxConcurrentCmds,
 		cmds,
+		nil,
 		newRunner(
-			WithMaxConcurrentCmds(maxConcurrentCmds),
-			WithEventHandler(eventHandler.Handle),
+			append(
+				[]RunnerOption{
+					WithMaxConcurrentCmds(maxConcurrentCmds),
+					WithEventHandler(eventHandler.Handle),
+				},
+				options...,
+			)...,
 		),
 		eventHandler,
 		stdout,
@@ -110,7 +713,25 @@ func newTestEnv(maxConcurrentCmds int, cmds []*exec.Cmd) *testEnv {
 }
 
 func (e *testEnv) run() error {
-	return e.runner.Run(ExecCmds(e.cmds))
+	return e.runner.Run(ExecCmds(e.cmds, e.execCmdOptions...))
+}
+
+// runTasks runs the commands as tasks with IDs a, b, c, ...
+// where dependsOn contains the dependencies of each command.
+func (e *testEnv) runTasks(dependsOn ...[]string) error {
+	tasks := make([]*Task, len(e.cmds))
+	for i, cmd := range e.cmds {
+		tasks[i] = &Task{
+			ID:        string(rune('a' + i)),
+			Cmd:       ExecCmd(cmd, e.execCmdOptions...),
+			DependsOn: dependsOn[i],
+		}
+	}
+	return e.runner.RunTasks(context.Background(), tasks)
+}
+
+func (e *testEnv) runContext(ctx context.Context) error {
+	return e.runner.RunContext(ctx, ExecCmds(e.cmds, e.execCmdOptions...))
 }
 
 type testEventHandler struct {
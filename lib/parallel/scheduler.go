@@ -0,0 +1,388 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// scheduler starts the Tasks of a single run once all their
+// dependencies have finished successfully, in order of rank as
+// slots and resource pools become available.
+//
+// Tasks can be added until the scheduler is closed, and the run is
+// done once the scheduler is closed and all its Tasks are finished.
+//
+// If the number of concurrent commands is limited, the Tasks are run
+// by a fixed pool of workers, and otherwise each Task is run on its
+// own goroutine once it is started. A cmdController is only created
+// for a Task once it is started or skipped, so that Tasks that are
+// waiting take as little memory as possible.
+type scheduler struct {
+	Runner     *runner
+	Ctx        context.Context
+	State      *runState
+	Tasks      []*Task
+	Order      []int
+	Ranks      []int
+	Dependents [][]int
+	// Remaining is the number of dependencies of each Task
+	// that have not finished yet.
+	Remaining []int
+	// Finished is whether each Task has finished or was skipped.
+	Finished    []bool
+	NumFinished int
+	// NumFailed is the number of Tasks whose commands failed.
+	NumFailed      int
+	CmdControllers []*cmdController
+	Semaphore      *semaphore
+	// StartLimiter limits how often Tasks are started, or is nil
+	// if there is no limit.
+	StartLimiter *startLimiter
+	// QueueC holds the indexes of the Tasks that were granted slots
+	// but were not picked up by a worker yet, or is nil if there is
+	// no pool of workers.
+	QueueC chan int
+	// BacklogC holds a value for every added Task that has not
+	// started yet, so that adding Tasks blocks when it is full,
+	// or is nil if there is no limit.
+	BacklogC chan struct{}
+	Closed   bool
+	Lock     sync.Mutex
+}
+
+func newScheduler(
+	runner *runner,
+	ctx context.Context,
+	state *runState,
+	tasks []*Task,
+	dependencies [][]int,
+	order []int,
+	ranks []int,
+	closed bool,
+) *scheduler {
+	dependents := make([][]int, len(tasks))
+	remaining := make([]int, len(tasks))
+	for i, taskDependencies := range dependencies {
+		for _, dependency := range taskDependencies {
+			dependents[dependency] = append(dependents[dependency], i)
+		}
+		remaining[i] = len(taskDependencies)
+	}
+	var backlogC chan struct{}
+	if !closed && runner.MaxQueuedCmds > 0 {
+		backlogC = make(chan struct{}, runner.MaxQueuedCmds)
+	}
+	return &scheduler{
+		Runner:         runner,
+		Ctx:            ctx,
+		State:          state,
+		Tasks:          tasks,
+		Order:          order,
+		Ranks:          ranks,
+		Dependents:     dependents,
+		Remaining:      remaining,
+		Finished:       make([]bool, len(tasks)),
+		CmdControllers: make([]*cmdController, len(tasks)),
+		Semaphore:      newSemaphore(runner.MaxConcurrentCmds, runner.ResourcePools),
+		StartLimiter:   newStartLimiter(runner.StartRate),
+		BacklogC:       backlogC,
+		Closed:         closed,
+	}
+}
+
+// Start starts the workers and enqueues the Tasks that have no
+// dependencies.
+func (s *scheduler) Start() {
+	if numWorkers := s.Runner.MaxConcurrentCmds; numWorkers > 0 {
+		if s.Closed && numWorkers > len(s.Tasks) {
+			numWorkers = len(s.Tasks)
+		}
+		// a Task holds at least one slot from when it is granted
+		// until it is done, so the queue can never be full
+		s.QueueC = make(chan int, s.Runner.MaxConcurrentCmds)
+		for i := 0; i < numWorkers; i++ {
+			go s.work()
+		}
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for _, index := range s.Order {
+		if s.Remaining[index] == 0 {
+			s.enqueue(index)
+		}
+	}
+	s.checkDone()
+}
+
+// Add adds a Task without dependencies for the command, which is
+// started after all the Tasks that were added before it. Add blocks
+// while the backlog is full, and returns false without adding the
+// Task if the scheduler is closed or the run is done.
+func (s *scheduler) Add(cmd Cmd) bool {
+	if s.BacklogC != nil {
+		select {
+		case s.BacklogC <- struct{}{}:
+		case <-s.State.DoneC:
+			return false
+		}
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	// the run may be done since the check above, or the select may
+	// have picked the backlog even though the run was done, and Tasks
+	// added once Results was called would never run nor be reported
+	select {
+	case <-s.State.DoneC:
+		s.releaseBacklog()
+		return false
+	default:
+	}
+	if s.Closed {
+		s.releaseBacklog()
+		return false
+	}
+	index := len(s.Tasks)
+	s.Tasks = append(s.Tasks, &Task{ID: strconv.Itoa(index), Cmd: cmd})
+	s.Ranks = append(s.Ranks, index)
+	s.Dependents = append(s.Dependents, nil)
+	s.Remaining = append(s.Remaining, 0)
+	s.Finished = append(s.Finished, false)
+	s.CmdControllers = append(s.CmdControllers, nil)
+	s.enqueue(index)
+	return true
+}
+
+// releaseBacklog releases the backlog slot taken by Add for a Task
+// that was not added.
+func (s *scheduler) releaseBacklog() {
+	if s.BacklogC != nil {
+		<-s.BacklogC
+	}
+}
+
+// Close closes the scheduler so that no more Tasks can be added.
+func (s *scheduler) Close() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Closed = true
+	s.checkDone()
+}
+
+// Kill kills all the commands that were started. Must be called once
+// the run is done.
+//
+// The workers exit on their own once the commands they run return from
+// Wait, which may be after Kill returns if descendants of the commands
+// still hold their output.
+//
+// If forwardedSignal is not nil, it is sent to the commands instead
+// of their stop signal.
+func (s *scheduler) Kill(reason error, forwardedSignal os.Signal) {
+	s.Lock.Lock()
+	var cmdControllers []*cmdController
+	for _, cmdController := range s.CmdControllers {
+		if cmdController != nil {
+			cmdControllers = append(cmdControllers, cmdController)
+		}
+	}
+	s.Lock.Unlock()
+	// commands are stopped concurrently as each may take up
+	// to the stop grace period
+	var wg sync.WaitGroup
+	for _, cmdController := range cmdControllers {
+		cmdController := cmdController
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmdController.Kill(reason, forwardedSignal)
+		}()
+	}
+	wg.Wait()
+}
+
+// Results returns the result of every Task, where Tasks that never
+// started are killed with the given reason. Must be called after Kill.
+func (s *scheduler) Results(reason error) []*CmdResult {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	results := make([]*CmdResult, len(s.Tasks))
+	for i := range s.Tasks {
+		cmdController := s.CmdControllers[i]
+		if cmdController == nil {
+			cmdController = s.newCmdController(i)
+			cmdController.Kill(reason, nil)
+			s.CmdControllers[i] = cmdController
+		}
+		results[i] = cmdController.GetResult()
+	}
+	return results
+}
+
+// Pgids returns the process groups the commands were started in.
+// Must be called after Results.
+func (s *scheduler) Pgids() []int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	var pgids []int
+	for _, cmdController := range s.CmdControllers {
+		if cmdController != nil {
+			pgids = append(pgids, cmdController.GetPgids()...)
+		}
+	}
+	return pgids
+}
+
+// checkDone marks the run as done if the scheduler is closed and
+// all Tasks are finished. Must be called with the lock held.
+func (s *scheduler) checkDone() {
+	if s.Closed && s.NumFinished == len(s.Tasks) {
+		s.State.Done()
+	}
+}
+
+func (s *scheduler) enqueue(index int) {
+	task := s.Tasks[index]
+	s.Semaphore.Enqueue(s.Ranks[index], getTaskWeight(task), task.Resources, func() {
+		if s.QueueC != nil {
+			s.QueueC <- index
+			return
+		}
+		go s.run(index)
+	})
+}
+
+func (s *scheduler) work() {
+	for {
+		select {
+		case <-s.State.DoneC:
+			return
+		case index := <-s.QueueC:
+			s.run(index)
+		}
+	}
+}
+
+// run runs the Task, which was granted its slots and resource pools.
+func (s *scheduler) run(index int) {
+	if s.StartLimiter != nil {
+		// if the run is done while waiting, start does not
+		// start the Task
+		s.StartLimiter.Wait(s.State.DoneC)
+	}
+	task, cmdController := s.start(index)
+	if s.BacklogC != nil {
+		<-s.BacklogC
+	}
+	if cmdController == nil {
+		s.Semaphore.V(getTaskWeight(task), task.Resources)
+		return
+	}
+	if err := cmdController.Run(s.Ctx); err != nil {
+		s.State.SetErr(err)
+		if s.Runner.FastFail {
+			s.State.Stop(stopReasonFastFail)
+		} else if s.Runner.FailureThreshold != nil && s.addFailure() {
+			s.State.Stop(stopReasonFailureThreshold)
+		}
+	}
+	s.Semaphore.V(getTaskWeight(task), task.Resources)
+	s.finish(index, cmdController.Succeeded())
+}
+
+// addFailure counts a failed Task, and returns true if the failure
+// threshold of the runner is reached.
+func (s *scheduler) addFailure() bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.NumFailed++
+	return s.Runner.FailureThreshold.isReached(s.NumFailed, len(s.Tasks))
+}
+
+// start returns the Task and a new cmdController for it, or a nil
+// cmdController if the run is done and the Task should not be started.
+func (s *scheduler) start(index int) (*Task, *cmdController) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	task := s.Tasks[index]
+	select {
+	case <-s.State.DoneC:
+		return task, nil
+	default:
+	}
+	s.CmdControllers[index] = s.newCmdController(index)
+	return task, s.CmdControllers[index]
+}
+
+// finish marks the Task as finished, and then either enqueues its
+// dependents that are ready if it succeeded, or skips all the Tasks
+// that depend on it directly or indirectly otherwise.
+//
+// Once the run is done, the dependents are left to Results, which
+// may already have been called, so that every Task gets exactly
+// one terminal Event.
+func (s *scheduler) finish(index int, succeeded bool) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Finished[index] = true
+	s.NumFinished++
+	select {
+	case <-s.State.DoneC:
+		return
+	default:
+	}
+	if succeeded {
+		for _, dependent := range s.Dependents[index] {
+			s.Remaining[dependent]--
+			if s.Remaining[dependent] == 0 && !s.Finished[dependent] {
+				s.enqueue(dependent)
+			}
+		}
+	} else {
+		// an explicit stack since dependency chains may be long
+		stack := []int{index}
+		for len(stack) > 0 {
+			failed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, dependent := range s.Dependents[failed] {
+				if s.Finished[dependent] {
+					continue
+				}
+				s.Finished[dependent] = true
+				s.NumFinished++
+				s.CmdControllers[dependent] = s.newCmdController(dependent)
+				s.CmdControllers[dependent].Skip(fmt.Errorf("dependency did not succeed: %v", s.Tasks[failed].Cmd))
+				stack = append(stack, dependent)
+			}
+		}
+	}
+	s.checkDone()
+}
+
+// newCmdController must be called with the lock held.
+func (s *scheduler) newCmdController(index int) *cmdController {
+	task := s.Tasks[index]
+	return newCmdController(task.Cmd, s.Runner.getCmdConfig(index, task), s.Runner.EventHandler, s.Runner.Clock)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerSubmissionOrder(t *testing.T) {
+	var started []string
+	var lock sync.Mutex
+	cmds := make([]Cmd, 100)
+	for i := range cmds {
+		name := strconv.Itoa(i)
+		cmds[i] = newTestNopCmd(name, func() {
+			lock.Lock()
+			defer lock.Unlock()
+			started = append(started, name)
+		}, nil)
+	}
+	require.NoError(t, newRunner(
+		WithMaxConcurrentCmds(1),
+		WithEventHandler(func(*Event) {}),
+	).Run(cmds))
+	expected := make([]string, len(cmds))
+	for i := range expected {
+		expected[i] = strconv.Itoa(i)
+	}
+	assert.Equal(t, expected, started)
+}
+
+func TestSchedulerSkipChain(t *testing.T) {
+	tasks := make([]*Task, 1000)
+	tasks[0] = &Task{ID: "0", Cmd: newTestNopCmd("0", nil, errors.New("failed"))}
+	for i := 1; i < len(tasks); i++ {
+		tasks[i] = &Task{
+			ID:        strconv.Itoa(i),
+			Cmd:       newTestNopCmd(strconv.Itoa(i), nil, nil),
+			DependsOn: []string{strconv.Itoa(i - 1)},
+		}
+	}
+	err := newRunner(WithEventHandler(func(*Event) {})).RunTasks(context.Background(), tasks)
+	require.Error(t, err)
+	require.IsType(t, &RunError{}, err)
+	results := err.(*RunError).Results
+	require.Len(t, results, len(tasks))
+	assert.False(t, results[0].Skipped)
+	for _, result := range results[1:] {
+		assert.True(t, result.Skipped)
+	}
+}
+
+func BenchmarkRun1000(b *testing.B) {
+	benchmarkRun(b, 1000)
+}
+
+func BenchmarkRun10000(b *testing.B) {
+	benchmarkRun(b, 10000)
+}
+
+func BenchmarkRun100000(b *testing.B) {
+	benchmarkRun(b, 100000)
+}
+
+func BenchmarkRunPool10000(b *testing.B) {
+	benchmarkRunPool(b, 10000)
+}
+
+func BenchmarkRunPool100000(b *testing.B) {
+	benchmarkRunPool(b, 100000)
+}
+
+func benchmarkRun(b *testing.B, numCmds int) {
+	cmds := make([]Cmd, numCmds)
+	for i := range cmds {
+		cmds[i] = newTestNopCmd(strconv.Itoa(i), nil, nil)
+	}
+	runner := newRunner(
+		WithMaxConcurrentCmds(8),
+		WithEventHandler(func(*Event) {}),
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := runner.Run(cmds); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkRunPool runs commands of which every other one needs a
+// resource pool that only one command can hold at once.
+func benchmarkRunPool(b *testing.B, numCmds int) {
+	tasks := make([]*Task, numCmds)
+	for i := range tasks {
+		tasks[i] = &Task{ID: strconv.Itoa(i), Cmd: newTestNopCmd(strconv.Itoa(i), nil, nil)}
+		if i%2 == 0 {
+			tasks[i].Resources = []string{"db"}
+		}
+	}
+	runner := newRunner(
+		WithMaxConcurrentCmds(8),
+		WithResourcePool("db", 1),
+		WithEventHandler(func(*Event) {}),
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := runner.RunTasks(context.Background(), tasks); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testNopCmd is a Cmd that does nothing but call onStart when it is
+// started, and return err from Wait.
+type testNopCmd struct {
+	name    string
+	onStart func()
+	err     error
+}
+
+func newTestNopCmd(name string, onStart func(), err error) *testNopCmd {
+	return &testNopCmd{name, onStart, err}
+}
+
+func (c *testNopCmd) Start() error {
+	if c.onStart != nil {
+		c.onStart()
+	}
+	return nil
+}
+
+func (c *testNopCmd) Wait() error {
+	return c.err
+}
+
+func (c *testNopCmd) Kill() error {
+	return nil
+}
+
+func (c *testNopCmd) String() string {
+	return c.name
+}
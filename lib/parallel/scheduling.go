@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SchedulingOrder returns the order in which the given Tasks should be
+// started, as a permutation of their indexes.
+//
+// Whenever there is room to start a command, the ready Task that comes
+// first in the order is started, so the order only matters when there
+// are more ready Tasks than the Runner can run at once.
+type SchedulingOrder func(tasks []*Task) []int
+
+// SubmissionOrder is a SchedulingOrder that starts the Tasks in the
+// order they were given to the Runner. This is the default.
+func SubmissionOrder(tasks []*Task) []int {
+	order := make([]int, len(tasks))
+	for i := range tasks {
+		order[i] = i
+	}
+	return order
+}
+
+// LongestFirst returns a SchedulingOrder that starts the Tasks with the
+// longest duration in durationHistory first, so that a slow command
+// does not start last and dominate the duration of the run.
+//
+// Tasks whose command is not in durationHistory are started before all
+// others, since they may be the longest. Tasks with the same expected
+// duration are started in the order they were given.
+func LongestFirst(durationHistory *DurationHistory) SchedulingOrder {
+	return func(tasks []*Task) []int {
+		order := SubmissionOrder(tasks)
+		durations := make([]int64, len(tasks))
+		for i, task := range tasks {
+			duration, ok := durationHistory.Duration(task.Cmd.String())
+			if !ok {
+				durations[i] = -1
+				continue
+			}
+			durations[i] = int64(duration)
+		}
+		sort.SliceStable(order, func(i int, j int) bool {
+			iDuration, jDuration := durations[order[i]], durations[order[j]]
+			if iDuration < 0 || jDuration < 0 {
+				return iDuration < 0 && jDuration >= 0
+			}
+			return iDuration > jDuration
+		})
+		return order
+	}
+}
+
+// getTaskOrder returns the order of the Tasks returned by
+// schedulingOrder, and the rank of each Task in that order, or error
+// if the order is not a permutation of the indexes of the Tasks.
+func getTaskOrder(tasks []*Task, schedulingOrder SchedulingOrder) ([]int, []int, error) {
+	if schedulingOrder == nil {
+		schedulingOrder = SubmissionOrder
+	}
+	order := schedulingOrder(tasks)
+	if len(order) != len(tasks) {
+		return nil, nil, fmt.Errorf("scheduling order has %d indexes for %d tasks", len(order), len(tasks))
+	}
+	ranks := make([]int, len(tasks))
+	for i := range ranks {
+		ranks[i] = -1
+	}
+	for rank, index := range order {
+		if index < 0 || index >= len(tasks) || ranks[index] != -1 {
+			return nil, nil, fmt.Errorf("scheduling order has invalid or duplicate index: %d", index)
+		}
+		ranks[index] = rank
+	}
+	return order, ranks, nil
+}
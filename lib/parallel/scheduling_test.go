@@ -0,0 +1,60 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLongestFirst(t *testing.T) {
+	tasks := []*Task{
+		newTestTask("a"),
+		{ID: "b", Cmd: ExecCmd(newSimpleCmd(0, "b", 0))},
+		{ID: "c", Cmd: ExecCmd(newSimpleCmd(0, "c", 0))},
+		{ID: "d", Cmd: ExecCmd(newSimpleCmd(0, "d", 0))},
+		{ID: "e", Cmd: ExecCmd(newSimpleCmd(0, "e", 0))},
+	}
+	durationHistory := NewDurationHistory()
+	durationHistory.Record(tasks[1].Cmd.String(), time.Second)
+	durationHistory.Record(tasks[2].Cmd.String(), 3*time.Second)
+	durationHistory.Record(tasks[4].Cmd.String(), time.Second)
+	// unknown durations first, then longest first, then submission order
+	assert.Equal(t, []int{0, 3, 2, 1, 4}, LongestFirst(durationHistory)(tasks))
+}
+
+func TestGetTaskOrder(t *testing.T) {
+	tasks := []*Task{newTestTask("a"), newTestTask("b"), newTestTask("c")}
+	order, ranks, err := getTaskOrder(tasks, func([]*Task) []int { return []int{2, 0, 1} })
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 0, 1}, order)
+	assert.Equal(t, []int{1, 2, 0}, ranks)
+
+	_, _, err = getTaskOrder(tasks, func([]*Task) []int { return []int{0, 1} })
+	require.EqualError(t, err, "scheduling order has 2 indexes for 3 tasks")
+	_, _, err = getTaskOrder(tasks, func([]*Task) []int { return []int{0, 1, 1} })
+	require.EqualError(t, err, "scheduling order has invalid or duplicate index: 1")
+	_, _, err = getTaskOrder(tasks, func([]*Task) []int { return []int{0, 1, 3} })
+	require.EqualError(t, err, "scheduling order has invalid or duplicate index: 3")
+}
@@ -20,33 +20,251 @@
 
 package parallel
 
-type semaphore chan struct{}
+import (
+	"container/heap"
+	"sync"
+)
 
-func newSemaphore(n int) semaphore {
-	if n <= 0 {
-		return nil
+// semaphore limits the command slots and the named resource pools
+// that running commands hold.
+//
+// Waiters take everything they need at once or nothing, so that
+// commands that need several slots or several pools can never
+// deadlock by each holding part of what another is waiting for.
+// Whenever slots or pools are released, they are granted to the
+// waiters in order of rank, and then of arrival.
+//
+// The first waiter whose pools are available has the released slots
+// reserved until it has enough of them, so that commands that need
+// many slots are not starved by later commands that need fewer.
+// Waiters that need a pool that is not available are parked by that
+// pool instead, so that they neither hold up the other waiters nor
+// have to be looked at again until the pool is released.
+type semaphore struct {
+	// MaxSlots is the total number of slots, or unlimited if 0.
+	MaxSlots int
+	// Limit is the number of slots that can be held at once,
+	// which is at most MaxSlots.
+	Limit int
+	// Slots is the number of slots that are available, which is
+	// negative if more than Limit slots are held.
+	Slots   int
+	Pools   map[string]int
+	Waiters semaphoreWaiters
+	// Parked holds the waiters that need each pool while it
+	// is not available.
+	Parked map[string]*semaphoreWaiters
+	// Seq is the number of requests so far, used to order
+	// requests with the same rank by arrival.
+	Seq  int
+	Lock sync.Mutex
+}
+
+// semaphoreWaiter is a request for slots and pools that is
+// waiting to be granted.
+type semaphoreWaiter struct {
+	Rank  int
+	Seq   int
+	N     int
+	Pools []string
+	// Granted is called with the lock held once the request is
+	// granted, and must not block.
+	Granted func()
+}
+
+// newSemaphore returns a new semaphore with n slots, or unlimited
+// slots if n is 0, and the given capacity for each named pool.
+func newSemaphore(n int, pools map[string]int) *semaphore {
+	if n < 0 {
+		n = 0
 	}
-	s := make(semaphore, n)
-	for i := 0; i < n; i++ {
-		s <- struct{}{}
+	s := &semaphore{
+		MaxSlots: n,
+		Limit:    n,
+		Slots:    n,
+		Pools:    make(map[string]int, len(pools)),
+		Parked:   make(map[string]*semaphoreWaiters, len(pools)),
+	}
+	for name, capacity := range pools {
+		s.Pools[name] = capacity
 	}
 	return s
 }
 
-func (s semaphore) P(n int) {
-	if s == nil {
+// P blocks until n slots and one unit of each of the given pools
+// are available, and acquires them.
+func (s *semaphore) P(n int, pools []string) {
+	grantedC := make(chan struct{})
+	s.Enqueue(0, n, pools, func() { close(grantedC) })
+	<-grantedC
+}
+
+// Enqueue adds a request for n slots and one unit of each of the
+// given pools, and calls granted once they are acquired, which may
+// be before Enqueue returns. Requests with a lower rank are granted
+// first.
+//
+// If n is greater than the total number of slots, all slots are
+// requested instead, so that the command runs alone.
+func (s *semaphore) Enqueue(rank int, n int, pools []string, granted func()) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Seq++
+	heap.Push(&s.Waiters, &semaphoreWaiter{
+		Rank:    rank,
+		Seq:     s.Seq,
+		N:       s.getSlots(n),
+		Pools:   pools,
+		Granted: granted,
+	})
+	s.grant()
+}
+
+// V releases n slots and one unit of each of the given pools,
+// which must have been acquired with P or Enqueue.
+func (s *semaphore) V(n int, pools []string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Slots += s.getSlots(n)
+	for _, pool := range pools {
+		s.Pools[pool]++
+	}
+	s.grant()
+}
+
+// SetLimit sets the number of slots that can be held at once to n,
+// clamped between 1 and the total number of slots. Slots held above
+// the new limit are not taken back, but no more are granted until
+// enough of them are released.
+func (s *semaphore) SetLimit(n int) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.MaxSlots == 0 {
 		return
 	}
-	for i := 0; i < n; i++ {
-		<-s
+	if n < 1 {
+		n = 1
+	}
+	if n > s.MaxSlots {
+		n = s.MaxSlots
 	}
+	s.Slots += n - s.Limit
+	s.Limit = n
+	s.grant()
 }
 
-func (s semaphore) V(n int) {
-	if s == nil {
-		return
+// grant grants the requests of the waiters in order, until the first
+// waiter whose pools are available does not fit in the slots.
+//
+// Must be called with the lock held.
+func (s *semaphore) grant() {
+	// every request takes at least one slot if slots are limited
+	for s.MaxSlots == 0 || s.Slots > 0 {
+		waiters := s.getNextWaiters()
+		if waiters == nil {
+			return
+		}
+		waiter := (*waiters)[0]
+		if pool, ok := s.getUnavailablePool(waiter.Pools); ok {
+			heap.Pop(waiters)
+			parked, ok := s.Parked[pool]
+			if !ok {
+				parked = &semaphoreWaiters{}
+				s.Parked[pool] = parked
+			}
+			heap.Push(parked, waiter)
+			continue
+		}
+		if !s.hasSlots(waiter.N) {
+			return
+		}
+		heap.Pop(waiters)
+		s.Slots -= waiter.N
+		for _, pool := range waiter.Pools {
+			s.Pools[pool]--
+		}
+		waiter.Granted()
+	}
+}
+
+// getNextWaiters returns the waiters whose first waiter is next in
+// order, among the waiters that are not parked and the waiters that
+// are parked by a pool that is available, or nil if there are none.
+func (s *semaphore) getNextWaiters() *semaphoreWaiters {
+	var next *semaphoreWaiters
+	if s.Waiters.Len() > 0 {
+		next = &s.Waiters
+	}
+	for pool, parked := range s.Parked {
+		if parked.Len() == 0 || s.Pools[pool] < 1 {
+			continue
+		}
+		if next == nil || (*parked)[0].isBefore((*next)[0]) {
+			next = parked
+		}
 	}
-	for i := 0; i < n; i++ {
-		s <- struct{}{}
+	return next
+}
+
+func (s *semaphore) getSlots(n int) int {
+	if s.MaxSlots == 0 {
+		return 0
+	}
+	if n > s.MaxSlots {
+		return s.MaxSlots
+	}
+	return n
+}
+
+func (s *semaphore) hasSlots(n int) bool {
+	// a request for more slots than the limit is granted once no
+	// slots are held, so that the command runs alone
+	return s.Slots >= n || (n > s.Limit && s.Slots >= s.Limit)
+}
+
+// getUnavailablePool returns the first of the pools that has
+// no unit available, if any.
+func (s *semaphore) getUnavailablePool(pools []string) (string, bool) {
+	for _, pool := range pools {
+		if s.Pools[pool] < 1 {
+			return pool, true
+		}
+	}
+	return "", false
+}
+
+// isBefore returns true if the waiter is granted before other.
+func (w *semaphoreWaiter) isBefore(other *semaphoreWaiter) bool {
+	if w.Rank != other.Rank {
+		return w.Rank < other.Rank
 	}
+	return w.Seq < other.Seq
+}
+
+// semaphoreWaiters is a heap of waiters ordered by rank, and then
+// by arrival.
+type semaphoreWaiters []*semaphoreWaiter
+
+func (w semaphoreWaiters) Len() int {
+	return len(w)
+}
+
+func (w semaphoreWaiters) Less(i int, j int) bool {
+	return w[i].isBefore(w[j])
+}
+
+func (w semaphoreWaiters) Swap(i int, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+
+func (w *semaphoreWaiters) Push(x interface{}) {
+	*w = append(*w, x.(*semaphoreWaiter))
+}
+
+func (w *semaphoreWaiters) Pop() interface{} {
+	old := *w
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	*w = old[:len(old)-1]
+	return waiter
 }
@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemaphoreWeight(t *testing.T) {
+	semaphore := newSemaphore(3, nil)
+	semaphore.P(2, nil)
+	heavyC := acquire(semaphore, 2, nil)
+	requireNotAcquired(t, heavyC)
+	// a lighter command that fits waits for the heavier one that
+	// came first, so that the heavier one is not starved
+	lightC := acquire(semaphore, 1, nil)
+	requireNotAcquired(t, lightC)
+	semaphore.V(2, nil)
+	requireAcquired(t, heavyC)
+	requireAcquired(t, lightC)
+}
+
+func TestSemaphoreWeightRank(t *testing.T) {
+	semaphore := newSemaphore(4, nil)
+	semaphore.P(4, nil)
+	heavyC := enqueue(semaphore, 1, 4)
+	var lightCs []<-chan struct{}
+	for i := 0; i < 4; i++ {
+		lightCs = append(lightCs, enqueue(semaphore, 2, 1))
+	}
+	// the slots that are released are reserved for the heavy
+	// command, which has a lower rank than the light ones
+	semaphore.V(1, nil)
+	semaphore.V(1, nil)
+	for _, lightC := range lightCs {
+		requireNotAcquired(t, lightC)
+	}
+	semaphore.V(2, nil)
+	requireAcquired(t, heavyC)
+	semaphore.V(4, nil)
+	for _, lightC := range lightCs {
+		requireAcquired(t, lightC)
+	}
+}
+
+func TestSemaphoreWeightOverMax(t *testing.T) {
+	semaphore := newSemaphore(2, nil)
+	semaphore.P(1, nil)
+	acquiredC := acquire(semaphore, 5, nil)
+	requireNotAcquired(t, acquiredC)
+	semaphore.V(1, nil)
+	requireAcquired(t, acquiredC)
+	requireNotAcquired(t, acquire(semaphore, 1, nil))
+}
+
+func TestSemaphoreUnlimited(t *testing.T) {
+	semaphore := newSemaphore(0, nil)
+	for i := 0; i < 10; i++ {
+		requireAcquired(t, acquire(semaphore, 100, nil))
+	}
+}
+
+func TestSemaphorePools(t *testing.T) {
+	semaphore := newSemaphore(0, map[string]int{"db": 1, "net": 1})
+	semaphore.P(1, []string{"db"})
+	// a command that needs both pools does not take net while it
+	// waits for db, so a command that only needs net can still start
+	bothC := acquire(semaphore, 1, []string{"net", "db"})
+	requireNotAcquired(t, bothC)
+	requireAcquired(t, acquire(semaphore, 1, []string{"net"}))
+	requireNotAcquired(t, bothC)
+	semaphore.V(1, []string{"net"})
+	requireNotAcquired(t, bothC)
+	semaphore.V(1, []string{"db"})
+	requireAcquired(t, bothC)
+}
+
+func TestSemaphorePoolsSlots(t *testing.T) {
+	semaphore := newSemaphore(2, map[string]int{"db": 1})
+	semaphore.P(1, []string{"db"})
+	dbC := acquire(semaphore, 1, []string{"db"})
+	requireNotAcquired(t, dbC)
+	// slots are not reserved for a command that waits for a pool
+	requireAcquired(t, acquire(semaphore, 1, nil))
+	semaphore.V(1, nil)
+	semaphore.V(1, []string{"db"})
+	requireAcquired(t, dbC)
+}
+
+func TestSemaphoreSetLimit(t *testing.T) {
+	semaphore := newSemaphore(4, nil)
+	semaphore.P(1, nil)
+	semaphore.P(1, nil)
+	semaphore.SetLimit(1)
+	oneC := acquire(semaphore, 1, nil)
+	requireNotAcquired(t, oneC)
+	semaphore.V(1, nil)
+	requireNotAcquired(t, oneC)
+	semaphore.V(1, nil)
+	requireAcquired(t, oneC)
+	// a command heavier than the limit runs alone
+	threeC := acquire(semaphore, 3, nil)
+	requireNotAcquired(t, threeC)
+	semaphore.SetLimit(10)
+	requireAcquired(t, threeC)
+	require.Equal(t, 4, semaphore.Limit)
+	require.Equal(t, 0, semaphore.Slots)
+}
+
+func TestSemaphoreRank(t *testing.T) {
+	semaphore := newSemaphore(1, nil)
+	semaphore.P(1, nil)
+	lowC := enqueue(semaphore, 2, 1)
+	highC := enqueue(semaphore, 1, 1)
+	semaphore.V(1, nil)
+	requireAcquired(t, highC)
+	requireNotAcquired(t, lowC)
+	semaphore.V(1, nil)
+	requireAcquired(t, lowC)
+}
+
+func enqueue(semaphore *semaphore, rank int, n int) <-chan struct{} {
+	grantedC := make(chan struct{})
+	semaphore.Enqueue(rank, n, nil, func() { close(grantedC) })
+	return grantedC
+}
+
+func acquire(semaphore *semaphore, n int, pools []string) <-chan struct{} {
+	acquiredC := make(chan struct{})
+	go func() {
+		semaphore.P(n, pools)
+		close(acquiredC)
+	}()
+	return acquiredC
+}
+
+func requireAcquired(t *testing.T, acquiredC <-chan struct{}) {
+	select {
+	case <-acquiredC:
+	case <-time.After(time.Second):
+		require.Fail(t, "semaphore not acquired")
+	}
+}
+
+func requireNotAcquired(t *testing.T, acquiredC <-chan struct{}) {
+	select {
+	case <-acquiredC:
+		require.Fail(t, "semaphore acquired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
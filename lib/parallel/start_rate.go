@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StartRate limits how often commands are started, as a token bucket
+// that holds up to Burst starts and is refilled with Starts starts
+// every Interval.
+type StartRate struct {
+	// Starts is the number of commands that can be started
+	// per Interval, and must be at least 1.
+	Starts int
+	// Interval is the interval over which Starts commands can be
+	// started, and must be positive.
+	Interval time.Duration
+	// Burst is the number of commands that can be started at once
+	// after no command was started for a while. If 0, Starts is used.
+	Burst int
+}
+
+func validateStartRate(startRate *StartRate) error {
+	if startRate.Starts < 1 {
+		return fmt.Errorf("start rate starts must be at least 1: %d", startRate.Starts)
+	}
+	if startRate.Interval <= 0 {
+		return fmt.Errorf("start rate interval must be positive: %v", startRate.Interval)
+	}
+	if startRate.Burst < 0 {
+		return fmt.Errorf("start rate burst is negative: %d", startRate.Burst)
+	}
+	return nil
+}
+
+// startLimiter is a token bucket for command starts.
+type startLimiter struct {
+	// Rate is the number of tokens added per second.
+	Rate  float64
+	Burst float64
+	// Tokens is the number of tokens as of Last, which is negative
+	// if starts are reserved ahead of time.
+	Tokens float64
+	Last   time.Time
+	Lock   sync.Mutex
+}
+
+// newStartLimiter returns a new startLimiter for the StartRate,
+// which starts full, or nil if startRate is nil.
+func newStartLimiter(startRate *StartRate) *startLimiter {
+	if startRate == nil {
+		return nil
+	}
+	burst := startRate.Burst
+	if burst == 0 {
+		burst = startRate.Starts
+	}
+	return &startLimiter{
+		Rate:   float64(startRate.Starts) / startRate.Interval.Seconds(),
+		Burst:  float64(burst),
+		Tokens: float64(burst),
+		Last:   time.Now(),
+	}
+}
+
+// Wait waits until a command can be started, or until doneC is
+// closed. Commands are let through in the order Wait is called.
+func (l *startLimiter) Wait(doneC <-chan struct{}) {
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-doneC:
+	}
+}
+
+// reserve takes a token, and returns how long to wait for it
+// to be available.
+func (l *startLimiter) reserve(now time.Time) time.Duration {
+	l.Lock.Lock()
+	defer l.Lock.Unlock()
+	l.Tokens += now.Sub(l.Last).Seconds() * l.Rate
+	if l.Tokens > l.Burst {
+		l.Tokens = l.Burst
+	}
+	l.Last = now
+	l.Tokens--
+	if l.Tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.Tokens / l.Rate * float64(time.Second))
+}
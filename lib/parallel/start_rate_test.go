@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartLimiter(t *testing.T) {
+	startLimiter := newStartLimiter(&StartRate{Starts: 2, Interval: time.Second, Burst: 3})
+	now := startLimiter.Last
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), startLimiter.reserve(now))
+	}
+	// the starts after the burst are spread at the rate
+	assert.Equal(t, 500*time.Millisecond, startLimiter.reserve(now))
+	assert.Equal(t, time.Second, startLimiter.reserve(now))
+	// the bucket refills, but never above the burst
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), startLimiter.reserve(now))
+	}
+	assert.Equal(t, 500*time.Millisecond, startLimiter.reserve(now))
+}
+
+func TestStartRate(t *testing.T) {
+	cmds := []*exec.Cmd{
+		newSimpleCmd(0, "1", 0),
+		newSimpleCmd(0, "2", 0),
+		newSimpleCmd(0, "3", 0),
+	}
+	testEnv := newTestEnv(3, cmds, WithStartRate(StartRate{Starts: 1, Interval: 200 * time.Millisecond}))
+	start := time.Now()
+	require.NoError(t, testEnv.run())
+	require.True(t, time.Since(start) >= 400*time.Millisecond)
+	testEnv.eventHandler.NumEventsForTypeSuccess(t, EventTypeCmdFinished, 3)
+}
+
+func TestStartRateInvalid(t *testing.T) {
+	runner := newRunner(WithStartRate(StartRate{Starts: 1}))
+	require.EqualError(t, runner.Run(nil), "start rate interval must be positive: 0s")
+}
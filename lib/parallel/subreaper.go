@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+// pidCmd is a Cmd that has a process ID.
+type pidCmd interface {
+	Pid() int
+}
+
+// pgidCmd is a Cmd that may run in its own process group.
+type pgidCmd interface {
+	// Pgid returns the process group of the command, or 0 if it
+	// does not run in its own process group.
+	Pgid() int
+}
+
+// childProcess is a child of the current process.
+type childProcess struct {
+	Pid  int
+	Pgid int
+	Cmd  string
+}
+
+// reapOrphans kills and reaps the children of the current process
+// that are in one of the given process groups of the commands but are
+// not one of the commands, which are descendants of the commands that
+// were re-parented to the child subreaper.
+//
+// Other children of the process, such as the commands of other runs,
+// are left alone, so that their exit status is not taken from them.
+func (r *runner) reapOrphans(cmds []Cmd, pgids []int) {
+	if len(pgids) == 0 {
+		return
+	}
+	cmdPids := make(map[int]struct{}, len(cmds))
+	for _, cmd := range cmds {
+		if pidCmd, ok := cmd.(pidCmd); ok {
+			cmdPids[pidCmd.Pid()] = struct{}{}
+		}
+	}
+	cmdPgids := make(map[int]struct{}, len(pgids))
+	for _, pgid := range pgids {
+		cmdPgids[pgid] = struct{}{}
+	}
+	childProcesses, err := getChildProcesses()
+	if err != nil {
+		r.EventHandler(newOrphanReapedEvent(r.Clock(), &childProcess{}, "", err))
+		return
+	}
+	for _, childProcess := range childProcesses {
+		if _, ok := cmdPgids[childProcess.Pgid]; !ok {
+			continue
+		}
+		if _, ok := cmdPids[childProcess.Pid]; ok {
+			continue
+		}
+		status, err := reapProcess(childProcess.Pid)
+		r.EventHandler(newOrphanReapedEvent(r.Clock(), childProcess, status, err))
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from linux/prctl.h.
+const prSetChildSubreaper = 36
+
+func setChildSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getChildProcesses() ([]*childProcess, error) {
+	pid := os.Getpid()
+	fileInfos, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var childProcesses []*childProcess
+	for _, fileInfo := range fileInfos {
+		childPid, err := strconv.Atoi(fileInfo.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join("/proc", fileInfo.Name(), "stat"))
+		if err != nil {
+			// the process may have exited since listing /proc
+			continue
+		}
+		// the command name is in parentheses and may contain spaces,
+		// so the fields to parse are after the last closing parenthesis
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		// fields are state, ppid, pgrp, ...
+		if len(fields) < 3 || fields[1] != strconv.Itoa(pid) {
+			continue
+		}
+		pgid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		childProcesses = append(childProcesses, &childProcess{childPid, pgid, getProcessCmd(childPid)})
+	}
+	return childProcesses, nil
+}
+
+func getProcessCmd(pid int) string {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Replace(string(data), "\x00", " ", -1))
+}
+
+// reapProcess kills the process if it is still running and waits
+// for it, returning a description of how it exited.
+func reapProcess(pid int) (string, error) {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return "", err
+	}
+	var waitStatus syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &waitStatus, 0, nil); err != nil {
+		return "", err
+	}
+	switch {
+	case waitStatus.Exited():
+		return "exit status " + strconv.Itoa(waitStatus.ExitStatus()), nil
+	case waitStatus.Signaled():
+		return "signal: " + waitStatus.Signal().String(), nil
+	default:
+		return "", nil
+	}
+}
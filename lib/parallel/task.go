@@ -0,0 +1,192 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errTaskNil = errors.New("task is nil")
+
+// Task is a command with an ID and dependencies on other Tasks.
+type Task struct {
+	// ID uniquely identifies the Task within a run.
+	ID string
+	// Name is an optional human readable name of the Task, that
+	// is used instead of the command string in Events, output
+	// and errors.
+	Name string
+	// Cmd is the command to run.
+	Cmd Cmd
+	// DependsOn are the IDs of the Tasks that must finish
+	// successfully before this Task is started.
+	//
+	// If any of them does not succeed, this Task is skipped.
+	DependsOn []string
+	// Timeout is the maximum duration the command can run for
+	// before it is killed. If 0, the Runner's command timeout is used.
+	Timeout time.Duration
+	// RetryPolicy is the retry policy of the command. If nil, the
+	// Runner's retry policy is used.
+	RetryPolicy *RetryPolicy
+	// Weight is the number of concurrent command slots the command
+	// takes while it runs. If 0, it takes 1. If greater than the
+	// maximum number of concurrent commands, the command runs alone.
+	// Commands that come after it in order wait until it has enough
+	// slots to start, even if they need fewer.
+	Weight int
+	// Resources are the names of the resource pools the command takes
+	// one unit of while it runs. Each must be registered with
+	// WithResourcePool.
+	Resources []string
+}
+
+func cmdsToTasks(cmds []Cmd) []*Task {
+	tasks := make([]*Task, len(cmds))
+	for i, cmd := range cmds {
+		tasks[i] = &Task{ID: strconv.Itoa(i), Cmd: cmd}
+	}
+	return tasks
+}
+
+// getTaskDependencies returns the indexes of the dependencies of
+// each Task, or error if the Tasks are invalid or have a cycle.
+func getTaskDependencies(tasks []*Task) ([][]int, error) {
+	idToIndex := make(map[string]int, len(tasks))
+	for i, task := range tasks {
+		if task == nil || task.Cmd == nil {
+			return nil, errTaskNil
+		}
+		if task.ID == "" {
+			return nil, fmt.Errorf("task has no ID: %s", getCmdName(task.Name, task.Cmd))
+		}
+		if _, ok := idToIndex[task.ID]; ok {
+			return nil, fmt.Errorf("duplicate task ID: %s", task.ID)
+		}
+		idToIndex[task.ID] = i
+	}
+	dependencies := make([][]int, len(tasks))
+	for i, task := range tasks {
+		for _, id := range task.DependsOn {
+			index, ok := idToIndex[id]
+			if !ok {
+				return nil, fmt.Errorf("task %s depends on unknown task %s", task.ID, id)
+			}
+			dependencies[i] = append(dependencies[i], index)
+		}
+	}
+	if cycle := findCycle(dependencies); len(cycle) > 0 {
+		ids := make([]string, len(cycle))
+		for i, index := range cycle {
+			ids[i] = tasks[index].ID
+		}
+		return nil, fmt.Errorf("task dependency cycle: %s", strings.Join(ids, " -> "))
+	}
+	return dependencies, nil
+}
+
+// getCmdName returns name, or the string representation of
+// the command if name is empty.
+func getCmdName(name string, cmd Cmd) string {
+	if name != "" {
+		return name
+	}
+	return cmd.String()
+}
+
+// getTaskWeight returns the number of command slots the Task takes.
+func getTaskWeight(task *Task) int {
+	if task.Weight == 0 {
+		return 1
+	}
+	return task.Weight
+}
+
+// validateTaskResources returns error if the Tasks have an invalid
+// weight, or use resource pools that are unknown or invalid.
+func validateTaskResources(tasks []*Task, resourcePools map[string]int) error {
+	for name, capacity := range resourcePools {
+		if capacity < 1 {
+			return fmt.Errorf("resource pool %s has invalid capacity: %d", name, capacity)
+		}
+	}
+	for _, task := range tasks {
+		if task.Weight < 0 {
+			return fmt.Errorf("task %s has negative weight: %d", task.ID, task.Weight)
+		}
+		seen := make(map[string]struct{}, len(task.Resources))
+		for _, resource := range task.Resources {
+			if _, ok := resourcePools[resource]; !ok {
+				return fmt.Errorf("task %s uses unknown resource pool %s", task.ID, resource)
+			}
+			if _, ok := seen[resource]; ok {
+				return fmt.Errorf("task %s uses resource pool %s more than once", task.ID, resource)
+			}
+			seen[resource] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// findCycle returns the indexes of a cycle in the dependency graph,
+// with the first index repeated at the end, or nil if there is none.
+func findCycle(dependencies [][]int) []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(dependencies))
+	var path []int
+	var visit func(int) []int
+	visit = func(index int) []int {
+		switch states[index] {
+		case visited:
+			return nil
+		case visiting:
+			for i, pathIndex := range path {
+				if pathIndex == index {
+					return append(append([]int{}, path[i:]...), index)
+				}
+			}
+		}
+		states[index] = visiting
+		path = append(path, index)
+		for _, dependency := range dependencies[index] {
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		states[index] = visited
+		return nil
+	}
+	for index := range dependencies {
+		if cycle := visit(index); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package parallel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetTaskDependencies(t *testing.T) {
+	for _, tt := range []struct {
+		name                 string
+		tasks                []*Task
+		expectedDependencies [][]int
+		expectedErr          string
+	}{
+		{
+			name: "valid",
+			tasks: []*Task{
+				newTestTask("a"),
+				newTestTask("b", "a"),
+				newTestTask("c", "a", "b"),
+			},
+			expectedDependencies: [][]int{nil, {0}, {0, 1}},
+		},
+		{
+			name:        "nil",
+			tasks:       []*Task{nil},
+			expectedErr: "task is nil",
+		},
+		{
+			name:        "no ID",
+			tasks:       []*Task{newTestTask("")},
+			expectedErr: "task has no ID: ./testdata/bin/simple.sh 0 1 0",
+		},
+		{
+			name:        "duplicate ID",
+			tasks:       []*Task{newTestTask("a"), newTestTask("a")},
+			expectedErr: "duplicate task ID: a",
+		},
+		{
+			name:        "unknown dependency",
+			tasks:       []*Task{newTestTask("a", "b")},
+			expectedErr: "task a depends on unknown task b",
+		},
+		{
+			name:        "self cycle",
+			tasks:       []*Task{newTestTask("a", "a")},
+			expectedErr: "task dependency cycle: a -> a",
+		},
+		{
+			name: "cycle",
+			tasks: []*Task{
+				newTestTask("a"),
+				newTestTask("b", "a", "d"),
+				newTestTask("c", "b"),
+				newTestTask("d", "c"),
+			},
+			expectedErr: "task dependency cycle: b -> d -> c -> b",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dependencies, err := getTaskDependencies(tt.tasks)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedDependencies, dependencies)
+		})
+	}
+}
+
+func TestValidateTaskResources(t *testing.T) {
+	resourcePools := map[string]int{"db": 1, "net": 2}
+	for _, tt := range []struct {
+		name          string
+		task          *Task
+		resourcePools map[string]int
+		expectedErr   string
+	}{
+		{
+			name: "valid",
+			task: &Task{ID: "a", Weight: 4, Resources: []string{"db", "net"}},
+		},
+		{
+			name:        "negative weight",
+			task:        &Task{ID: "a", Weight: -1},
+			expectedErr: "task a has negative weight: -1",
+		},
+		{
+			name:        "unknown resource pool",
+			task:        &Task{ID: "a", Resources: []string{"disk"}},
+			expectedErr: "task a uses unknown resource pool disk",
+		},
+		{
+			name:        "duplicate resource pool",
+			task:        &Task{ID: "a", Resources: []string{"db", "db"}},
+			expectedErr: "task a uses resource pool db more than once",
+		},
+		{
+			name:          "invalid capacity",
+			task:          &Task{ID: "a"},
+			resourcePools: map[string]int{"db": 0},
+			expectedErr:   "resource pool db has invalid capacity: 0",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pools := resourcePools
+			if tt.resourcePools != nil {
+				pools = tt.resourcePools
+			}
+			err := validateTaskResources([]*Task{tt.task}, pools)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func newTestTask(id string, dependsOn ...string) *Task {
+	return &Task{ID: id, Cmd: ExecCmd(newSimpleCmd(0, "1", 0)), DependsOn: dependsOn}
+}
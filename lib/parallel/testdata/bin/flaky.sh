@@ -0,0 +1,9 @@
+#!/bin/sh
+
+# fail with exit code ${3} the first time, and succeed after that
+if [ -f "${1}" ]; then
+  echo ${2}
+  exit 0
+fi
+touch "${1}"
+exit ${3}
@@ -0,0 +1,5 @@
+#!/bin/sh
+
+# leave a child running after exiting
+sleep ${1} >/dev/null 2>&1 &
+echo ${2}
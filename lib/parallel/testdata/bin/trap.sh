@@ -0,0 +1,11 @@
+#!/bin/sh
+
+if [ "${2}" = "ignore" ]; then
+  trap '' TERM
+else
+  trap 'echo terminated; exit 0' TERM
+fi
+sleep ${1} >/dev/null 2>&1 &
+# wait returns when a trapped signal is received
+wait
+wait
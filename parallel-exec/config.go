@@ -0,0 +1,527 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/tools/lib/parallel"
+
+	"github.com/mattn/go-shellwords"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	errConfigNil               = errors.New("config is nil")
+	errConfigCommandsEmpty     = errors.New("config commands is empty")
+	errConfigCommandsAndStages = errors.New("config cannot have both commands and stages")
+	errStageNil                = errors.New("stage is nil")
+	errStageCommandsEmpty      = errors.New("commands is empty")
+	errFailureThresholdEmpty   = errors.New("failure_threshold: failures or percent is required")
+)
+
+type config struct {
+	Dir      string     `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Commands []*command `json:"commands,omitempty" yaml:"commands,omitempty"`
+	Stages   []*stage   `json:"stages,omitempty" yaml:"stages,omitempty"`
+	// ResourcePools is the capacity of each named resource pool
+	// that commands can use.
+	ResourcePools map[string]int `json:"resource_pools,omitempty" yaml:"resource_pools,omitempty"`
+	// CgroupParent is the cgroup v2 directory to create the cgroups
+	// of commands with memory or CPU limits in.
+	CgroupParent string `json:"cgroup_parent,omitempty" yaml:"cgroup_parent,omitempty"`
+	// StartRate limits how often commands are started.
+	StartRate *startRate `json:"start_rate,omitempty" yaml:"start_rate,omitempty"`
+	// FailureThreshold stops a run once enough commands failed.
+	FailureThreshold *failureThreshold `json:"failure_threshold,omitempty" yaml:"failure_threshold,omitempty"`
+}
+
+// startRate allows starts commands to be started per interval,
+// and burst commands to be started at once.
+type startRate struct {
+	Starts   int    `json:"starts,omitempty" yaml:"starts,omitempty"`
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Burst    int    `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+// failureThreshold stops a run once failures commands failed, or once
+// more than percent of its commands failed.
+type failureThreshold struct {
+	Failures int     `json:"failures,omitempty" yaml:"failures,omitempty"`
+	Percent  float64 `json:"percent,omitempty" yaml:"percent,omitempty"`
+}
+
+// stage is a group of commands that are run in parallel, once all
+// the previous stages have finished successfully.
+type stage struct {
+	Name     string     `json:"name,omitempty" yaml:"name,omitempty"`
+	Commands []*command `json:"commands,omitempty" yaml:"commands,omitempty"`
+	// MaxConcurrentCmds overrides the max-concurrent-cmds flag if set.
+	MaxConcurrentCmds *int `json:"max_concurrent_cmds,omitempty" yaml:"max_concurrent_cmds,omitempty"`
+	// FastFail overrides the fast-fail flag if set.
+	FastFail *bool `json:"fast_fail,omitempty" yaml:"fast_fail,omitempty"`
+}
+
+// command is a single command in the config, which is either
+// a plain string, or an object with at least cmd set.
+type command struct {
+	Name    string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Cmd     string            `json:"cmd,omitempty" yaml:"cmd,omitempty"`
+	Dir     string            `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout string            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Retries int               `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Tags    []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// Weight is the number of concurrent command slots the command takes.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// Resources are the names of the resource pools the command uses.
+	Resources []string `json:"resources,omitempty" yaml:"resources,omitempty"`
+	// Limits are the resource limits of the command.
+	Limits *limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+}
+
+// limits are the resource limits of a command, where sizes are in
+// bytes with an optional K, M, G or T suffix.
+type limits struct {
+	AddressSpace string  `json:"address_space,omitempty" yaml:"address_space,omitempty"`
+	OpenFiles    uint64  `json:"open_files,omitempty" yaml:"open_files,omitempty"`
+	CPUTime      string  `json:"cpu_time,omitempty" yaml:"cpu_time,omitempty"`
+	MemoryMax    string  `json:"memory_max,omitempty" yaml:"memory_max,omitempty"`
+	CPUs         float64 `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+}
+
+// rawCommand has the fields of command without its methods.
+type rawCommand command
+
+// UnmarshalYAML unmarshals the command from either a string or an object.
+func (c *command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err == nil {
+		*c = command{Cmd: line}
+		return nil
+	}
+	var raw rawCommand
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = command(raw)
+	return nil
+}
+
+// MarshalJSON marshals the command to a string if only cmd is set,
+// and to an object otherwise.
+func (c *command) MarshalJSON() ([]byte, error) {
+	if c.isPlain() {
+		return json.Marshal(c.Cmd)
+	}
+	return json.Marshal((*rawCommand)(c))
+}
+
+func (c *command) isPlain() bool {
+	return c.Name == "" &&
+		c.Dir == "" &&
+		len(c.Env) == 0 &&
+		c.Timeout == "" &&
+		c.Retries == 0 &&
+		len(c.Tags) == 0 &&
+		c.Weight == 0 &&
+		len(c.Resources) == 0 &&
+		c.Limits == nil
+}
+
+// String returns the name of the command if set, and the command line otherwise.
+func (c *command) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Cmd
+}
+
+// HasAnyTag returns true if the command has any of the given tags,
+// or if no tags are given.
+func (c *command) HasAnyTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		for _, commandTag := range c.Tags {
+			if tag == commandTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func readConfig(configFilePath string) (*config, error) {
+	data, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	config := &config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Dir(configFilePath)
+	} else if !filepath.IsAbs(config.Dir) {
+		config.Dir = filepath.Join(filepath.Dir(configFilePath), config.Dir)
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func validateConfig(config *config) error {
+	if config == nil {
+		return errConfigNil
+	}
+	if len(config.Commands) == 0 && len(config.Stages) == 0 {
+		return errConfigCommandsEmpty
+	}
+	if len(config.Commands) > 0 && len(config.Stages) > 0 {
+		return errConfigCommandsAndStages
+	}
+	for name, capacity := range config.ResourcePools {
+		if capacity < 1 {
+			return fmt.Errorf("resource_pools (%s): capacity must be at least 1: %d", name, capacity)
+		}
+	}
+	if _, err := getStartRate(config.StartRate); err != nil {
+		return err
+	}
+	if _, err := getFailureThreshold(config.FailureThreshold); err != nil {
+		return err
+	}
+	// command names are unique across all stages
+	commandNames := make(map[string]string)
+	if err := validateCommands("", config.Commands, config, commandNames); err != nil {
+		return err
+	}
+	stageNames := make(map[string]string)
+	for i, stage := range config.Stages {
+		location := getLocation("", "stages", i, "")
+		if stage == nil {
+			return fmt.Errorf("%s: %v", location, errStageNil)
+		}
+		location = getLocation("", "stages", i, stage.Name)
+		if len(stage.Commands) == 0 {
+			return fmt.Errorf("%s: %v", location, errStageCommandsEmpty)
+		}
+		if stage.MaxConcurrentCmds != nil && *stage.MaxConcurrentCmds < 0 {
+			return fmt.Errorf("%s: max_concurrent_cmds is negative: %d", location, *stage.MaxConcurrentCmds)
+		}
+		if stage.Name != "" {
+			if other, ok := stageNames[stage.Name]; ok {
+				return fmt.Errorf("%s: duplicate name, also used by %s", location, other)
+			}
+			stageNames[stage.Name] = location
+		}
+		if err := validateCommands(location+": ", stage.Commands, config, commandNames); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCommands validates the commands, whose locations in the
+// config start with prefix, and adds their names to names.
+func validateCommands(
+	prefix string,
+	commands []*command,
+	config *config,
+	names map[string]string,
+) error {
+	for i, command := range commands {
+		location := getLocation(prefix, "commands", i, "")
+		if command != nil {
+			location = getLocation(prefix, "commands", i, command.Name)
+		}
+		if err := validateCommand(command, config); err != nil {
+			return fmt.Errorf("%s: %v", location, err)
+		}
+		if command.Name == "" {
+			continue
+		}
+		if other, ok := names[command.Name]; ok {
+			return fmt.Errorf("%s: duplicate name, also used by %s", location, other)
+		}
+		names[command.Name] = location
+	}
+	return nil
+}
+
+func validateCommand(command *command, config *config) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+	// empty plain strings are skipped for backwards compatibility
+	if command.isPlain() {
+		return nil
+	}
+	if command.Cmd == "" {
+		return errors.New("cmd is empty")
+	}
+	if _, err := getTimeout(command); err != nil {
+		return err
+	}
+	if command.Retries < 0 {
+		return fmt.Errorf("retries is negative: %d", command.Retries)
+	}
+	if command.Weight < 0 {
+		return fmt.Errorf("weight is negative: %d", command.Weight)
+	}
+	seen := make(map[string]struct{}, len(command.Resources))
+	for _, resource := range command.Resources {
+		if _, ok := config.ResourcePools[resource]; !ok {
+			return fmt.Errorf("unknown resource pool: %s", resource)
+		}
+		if _, ok := seen[resource]; ok {
+			return fmt.Errorf("duplicate resource pool: %s", resource)
+		}
+		seen[resource] = struct{}{}
+	}
+	if _, err := getLimits(command, config.CgroupParent); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getLocation returns the location of an entry in the config,
+// such as "stages[0] (lint): commands[1] (vet)".
+func getLocation(prefix string, key string, index int, name string) string {
+	if name != "" {
+		return fmt.Sprintf("%s%s[%d] (%s)", prefix, key, index, name)
+	}
+	return fmt.Sprintf("%s%s[%d]", prefix, key, index)
+}
+
+func getTimeout(command *command) (time.Duration, error) {
+	if command.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(command.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %v", err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("timeout is negative: %v", timeout)
+	}
+	return timeout, nil
+}
+
+// getStartRate returns the start rate, or nil if there is none.
+func getStartRate(startRate *startRate) (*parallel.StartRate, error) {
+	if startRate == nil {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(startRate.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("start_rate: invalid interval: %v", err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("start_rate: interval must be positive: %v", interval)
+	}
+	if startRate.Starts < 1 {
+		return nil, fmt.Errorf("start_rate: starts must be at least 1: %d", startRate.Starts)
+	}
+	if startRate.Burst < 0 {
+		return nil, fmt.Errorf("start_rate: burst is negative: %d", startRate.Burst)
+	}
+	return &parallel.StartRate{Starts: startRate.Starts, Interval: interval, Burst: startRate.Burst}, nil
+}
+
+// getFailureThreshold returns the failure threshold, or nil if
+// there is none.
+func getFailureThreshold(failureThreshold *failureThreshold) (*parallel.FailureThreshold, error) {
+	if failureThreshold == nil {
+		return nil, nil
+	}
+	if failureThreshold.Failures < 0 {
+		return nil, fmt.Errorf("failure_threshold: failures is negative: %d", failureThreshold.Failures)
+	}
+	if failureThreshold.Percent < 0 || failureThreshold.Percent > 100 {
+		return nil, fmt.Errorf("failure_threshold: percent must be between 0 and 100: %v", failureThreshold.Percent)
+	}
+	if failureThreshold.Failures == 0 && failureThreshold.Percent == 0 {
+		return nil, errFailureThresholdEmpty
+	}
+	return &parallel.FailureThreshold{Failures: failureThreshold.Failures, Percent: failureThreshold.Percent}, nil
+}
+
+// parseStartRate parses a start rate such as "8/1s" for
+// 8 starts per second.
+func parseStartRate(s string) (*startRate, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid start rate, expected starts/interval: %s", s)
+	}
+	starts, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start rate starts: %v", err)
+	}
+	return &startRate{Starts: starts, Interval: s[i+1:]}, nil
+}
+
+// getLimits returns the limits of the command, or nil if it has none.
+func getLimits(command *command, cgroupParent string) (*parallel.Limits, error) {
+	if command.Limits == nil {
+		return nil, nil
+	}
+	limits := &parallel.Limits{
+		OpenFiles:    command.Limits.OpenFiles,
+		CgroupParent: cgroupParent,
+		CPUs:         command.Limits.CPUs,
+	}
+	var err error
+	if limits.AddressSpace, err = parseSize(command.Limits.AddressSpace); err != nil {
+		return nil, fmt.Errorf("invalid limits address_space: %v", err)
+	}
+	if limits.MemoryMax, err = parseSize(command.Limits.MemoryMax); err != nil {
+		return nil, fmt.Errorf("invalid limits memory_max: %v", err)
+	}
+	if command.Limits.CPUTime != "" {
+		if limits.CPUTime, err = time.ParseDuration(command.Limits.CPUTime); err != nil {
+			return nil, fmt.Errorf("invalid limits cpu_time: %v", err)
+		}
+		if limits.CPUTime < 0 {
+			return nil, fmt.Errorf("limits cpu_time is negative: %v", limits.CPUTime)
+		}
+	}
+	if limits.CPUs < 0 {
+		return nil, fmt.Errorf("limits cpus is negative: %v", limits.CPUs)
+	}
+	if (limits.MemoryMax > 0 || limits.CPUs > 0) && cgroupParent == "" {
+		return nil, errors.New("limits memory_max and cpus require cgroup_parent")
+	}
+	return limits, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T
+// suffix for powers of 1024, or returns 0 if size is empty.
+func parseSize(size string) (uint64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := uint64(1)
+	if i := strings.IndexByte("KMGT", size[len(size)-1]); i >= 0 {
+		multiplier = 1 << (10 * uint(i+1))
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("size is too large: %s", size)
+	}
+	return value * multiplier, nil
+}
+
+// getTasks returns the Tasks for the commands that have any of the
+// given tags.
+func getTasks(
+	commands []*command,
+	dirPath string,
+	cgroupParent string,
+	tags []string,
+	retryBackoff time.Duration,
+	execCmdOptions ...parallel.ExecCmdOption,
+) ([]*parallel.Task, error) {
+	var tasks []*parallel.Task
+	for i, command := range commands {
+		if command.Cmd == "" || !command.HasAnyTag(tags) {
+			continue
+		}
+		args, err := shellwords.Parse(command.Cmd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", getLocation("", "commands", i, command.Name), err)
+		}
+		// could happen if args = "$FOO" and FOO is not set
+		if len(args) == 0 {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dirPath
+		if command.Dir != "" {
+			cmd.Dir = command.Dir
+			if !filepath.IsAbs(cmd.Dir) {
+				cmd.Dir = filepath.Join(dirPath, cmd.Dir)
+			}
+		}
+		if len(command.Env) > 0 {
+			cmd.Env = append(os.Environ(), getEnv(command.Env)...)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		// errors were checked in validateConfig
+		timeout, _ := getTimeout(command)
+		limits, _ := getLimits(command, cgroupParent)
+		cmdOptions := execCmdOptions
+		if limits != nil {
+			cmdOptions = append(append([]parallel.ExecCmdOption{}, execCmdOptions...), parallel.WithLimits(*limits))
+		}
+		task := &parallel.Task{
+			ID:        strconv.Itoa(i),
+			Name:      command.Name,
+			Cmd:       parallel.ExecCmd(cmd, cmdOptions...),
+			Timeout:   timeout,
+			Weight:    command.Weight,
+			Resources: command.Resources,
+		}
+		if command.Retries > 0 {
+			task.RetryPolicy = &parallel.RetryPolicy{
+				MaxAttempts:       command.Retries + 1,
+				Backoff:           retryBackoff,
+				BackoffMultiplier: 2,
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// getEnv returns the environment variables in KEY=VALUE form,
+// sorted by key.
+func getEnv(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = key + "=" + env[key]
+	}
+	return result
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/tools/lib/parallel"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigCommands(t *testing.T) {
+	config := &config{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+commands:
+  - echo plain
+  - name: named
+    cmd: echo named
+    dir: sub
+    env:
+      FOO: bar
+    timeout: 1s
+    retries: 2
+    tags: [a, b]
+`), config))
+	require.NoError(t, validateConfig(config))
+	require.Len(t, config.Commands, 2)
+	assert.Equal(t, &command{Cmd: "echo plain"}, config.Commands[0])
+	assert.Equal(t, &command{
+		Name:    "named",
+		Cmd:     "echo named",
+		Dir:     "sub",
+		Env:     map[string]string{"FOO": "bar"},
+		Timeout: "1s",
+		Retries: 2,
+		Tags:    []string{"a", "b"},
+	}, config.Commands[1])
+
+	data, err := json.Marshal(config.Commands)
+	require.NoError(t, err)
+	assert.Equal(t, `["echo plain",{"name":"named","cmd":"echo named","dir":"sub","env":{"FOO":"bar"},"timeout":"1s","retries":2,"tags":["a","b"]}]`, string(data))
+
+	tasks, err := getTasks(config.Commands, "/base", "", []string{"b"}, 0)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "1", tasks[0].ID)
+	assert.Equal(t, "named", tasks[0].Name)
+	assert.Equal(t, "echo named", tasks[0].Cmd.String())
+	require.NotNil(t, tasks[0].RetryPolicy)
+	assert.Equal(t, 3, tasks[0].RetryPolicy.MaxAttempts)
+}
+
+func TestGetLimits(t *testing.T) {
+	config := &config{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+cgroup_parent: /sys/fs/cgroup/ci
+commands:
+  - cmd: echo
+    limits:
+      address_space: 2G
+      open_files: 1024
+      cpu_time: 1m
+      memory_max: 512M
+      cpus: 1.5
+`), config))
+	require.NoError(t, validateConfig(config))
+	limits, err := getLimits(config.Commands[0], config.CgroupParent)
+	require.NoError(t, err)
+	assert.Equal(t, &parallel.Limits{
+		AddressSpace: 2 << 30,
+		OpenFiles:    1024,
+		CPUTime:      time.Minute,
+		CgroupParent: "/sys/fs/cgroup/ci",
+		MemoryMax:    512 << 20,
+		CPUs:         1.5,
+	}, limits)
+
+	size, err := parseSize("4096")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4096), size)
+	_, err = parseSize("16777216T")
+	require.EqualError(t, err, "size is too large: 16777216")
+}
+
+func TestGetStartRate(t *testing.T) {
+	config := &config{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+start_rate: {starts: 4, interval: 1s, burst: 2}
+commands: [echo]
+`), config))
+	require.NoError(t, validateConfig(config))
+	startRate, err := getStartRate(config.StartRate)
+	require.NoError(t, err)
+	assert.Equal(t, &parallel.StartRate{Starts: 4, Interval: time.Second, Burst: 2}, startRate)
+
+	flagStartRate, err := parseStartRate("8/500ms")
+	require.NoError(t, err)
+	startRate, err = getStartRate(flagStartRate)
+	require.NoError(t, err)
+	assert.Equal(t, &parallel.StartRate{Starts: 8, Interval: 500 * time.Millisecond}, startRate)
+	_, err = parseStartRate("8")
+	require.EqualError(t, err, "invalid start rate, expected starts/interval: 8")
+}
+
+func TestGetFailureThreshold(t *testing.T) {
+	config := &config{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+failure_threshold: {failures: 10, percent: 5}
+commands: [echo]
+`), config))
+	require.NoError(t, validateConfig(config))
+	failureThreshold, err := getFailureThreshold(config.FailureThreshold)
+	require.NoError(t, err)
+	assert.Equal(t, &parallel.FailureThreshold{Failures: 10, Percent: 5}, failureThreshold)
+	failureThreshold, err = getFailureThreshold(nil)
+	require.NoError(t, err)
+	assert.Nil(t, failureThreshold)
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "empty cmd",
+			input: "commands: [{name: foo}]",
+			err:   "commands[0] (foo): cmd is empty",
+		},
+		{
+			name:  "invalid timeout",
+			input: "commands: [echo, {cmd: echo, timeout: foo}]",
+			err:   `commands[1]: invalid timeout: time: invalid duration`,
+		},
+		{
+			name:  "negative retries",
+			input: "commands: [{cmd: echo, retries: -1}]",
+			err:   "commands[0]: retries is negative: -1",
+		},
+		{
+			name:  "duplicate name",
+			input: "commands: [{name: foo, cmd: echo}, {name: foo, cmd: echo}]",
+			err:   "commands[1] (foo): duplicate name, also used by commands[0]",
+		},
+		{
+			name:  "negative weight",
+			input: "commands: [{cmd: echo, weight: -1}]",
+			err:   "commands[0]: weight is negative: -1",
+		},
+		{
+			name:  "unknown resource pool",
+			input: "{resource_pools: {db: 1}, commands: [{cmd: echo, resources: [db, net]}]}",
+			err:   "commands[0]: unknown resource pool: net",
+		},
+		{
+			name:  "invalid resource pool capacity",
+			input: "{resource_pools: {db: 0}, commands: [echo]}",
+			err:   "resource_pools (db): capacity must be at least 1: 0",
+		},
+		{
+			name:  "invalid limits size",
+			input: "commands: [{cmd: echo, limits: {address_space: 1X}}]",
+			err:   `commands[0]: invalid limits address_space: strconv.ParseUint: parsing "1X": invalid syntax`,
+		},
+		{
+			name:  "negative limits cpu time",
+			input: "commands: [{cmd: echo, limits: {cpu_time: -1s}}]",
+			err:   "commands[0]: limits cpu_time is negative: -1s",
+		},
+		{
+			name:  "limits without cgroup parent",
+			input: "commands: [{cmd: echo, limits: {memory_max: 1G}}]",
+			err:   "commands[0]: limits memory_max and cpus require cgroup_parent",
+		},
+		{
+			name:  "invalid start rate interval",
+			input: "{start_rate: {starts: 1, interval: 0s}, commands: [echo]}",
+			err:   "start_rate: interval must be positive: 0s",
+		},
+		{
+			name:  "invalid start rate starts",
+			input: "{start_rate: {interval: 1s}, commands: [echo]}",
+			err:   "start_rate: starts must be at least 1: 0",
+		},
+		{
+			name:  "empty failure threshold",
+			input: "{failure_threshold: {}, commands: [echo]}",
+			err:   "failure_threshold: failures or percent is required",
+		},
+		{
+			name:  "invalid failure threshold percent",
+			input: "{failure_threshold: {percent: 101}, commands: [echo]}",
+			err:   "failure_threshold: percent must be between 0 and 100: 101",
+		},
+		{
+			name:  "commands and stages",
+			input: "{commands: [echo], stages: [{commands: [echo]}]}",
+			err:   "config cannot have both commands and stages",
+		},
+		{
+			name:  "stage without commands",
+			input: "stages: [{commands: [echo]}, {name: lint}]",
+			err:   "stages[1] (lint): commands is empty",
+		},
+		{
+			name:  "stage with negative max concurrent cmds",
+			input: "stages: [{commands: [echo], max_concurrent_cmds: -1}]",
+			err:   "stages[0]: max_concurrent_cmds is negative: -1",
+		},
+		{
+			name:  "duplicate stage name",
+			input: "stages: [{name: lint, commands: [echo]}, {name: lint, commands: [echo]}]",
+			err:   "stages[1] (lint): duplicate name, also used by stages[0] (lint)",
+		},
+		{
+			name:  "stage command",
+			input: "stages: [{name: lint, commands: [echo, {cmd: echo, retries: -1}]}]",
+			err:   "stages[0] (lint): commands[1]: retries is negative: -1",
+		},
+		{
+			name:  "duplicate name across stages",
+			input: "stages: [{commands: [{name: foo, cmd: echo}]}, {commands: [{name: foo, cmd: echo}]}]",
+			err:   "stages[1]: commands[0] (foo): duplicate name, also used by stages[0]: commands[0] (foo)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &config{}
+			require.NoError(t, yaml.Unmarshal([]byte(tt.input), config))
+			err := validateConfig(config)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
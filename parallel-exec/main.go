@@ -21,38 +21,61 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"go.uber.org/tools/lib/parallel"
+)
 
-	"github.com/mattn/go-shellwords"
-	"gopkg.in/yaml.v2"
+const (
+	outputDirect   = "direct"
+	outputPrefixed = "prefixed"
+	outputGrouped  = "grouped"
 )
 
 var (
 	flagDir               = flag.String("dir", "", "The directory to run the commands in")
 	flagFastFail          = flag.Bool("fast-fail", false, "Fail on the first command failure")
+	flagMaxFailures       = flag.Int("max-failures", 0, "Stop once this many commands failed, overriding the config, or never if 0")
+	flagMaxFailurePercent = flag.Float64("max-failure-percent", 0, "Stop once more than this percentage of the commands failed, overriding the config, or never if 0")
 	flagMaxConcurrentCmds = flag.Int("max-concurrent-cmds", runtime.NumCPU(), "Maximum number of processes to run concurrently, or unlimited if 0")
+	flagMinConcurrentCmds = flag.Int("min-concurrent-cmds", 0, "Adapt the number of processes to run concurrently to the system load between this and max-concurrent-cmds, or never if 0")
 	flagNoLog             = flag.Bool("no-log", false, "Do not output logs")
+	flagOutput            = flag.String("output", outputDirect, "The output mode, either direct, prefixed, or grouped")
+	flagOutputColor       = flag.Bool("output-color", false, "Color the output prefixes when the output mode is prefixed")
+	flagCmdTimeout        = flag.Duration("cmd-timeout", 0, "Kill commands that run for longer than this duration, or never if 0")
+	flagRunTimeout        = flag.Duration("run-timeout", 0, "Kill all commands if the run takes longer than this duration, or never if 0")
+	flagRetries           = flag.Int("retries", 0, "Number of times to retry failed commands")
+	flagRetryBackoff      = flag.Duration("retry-backoff", 0, "Duration to wait before retrying a failed command, doubled after each retry")
+	flagProcessGroup      = flag.Bool("process-group", false, "Run each command in its own process group, and signal the whole group")
+	flagChildSubreaper    = flag.Bool("child-subreaper", false, "Reap orphaned descendants of the commands that stay in their process groups, implies process-group, Linux only")
+	flagGracePeriod       = flag.Duration("grace-period", 0, "Send SIGTERM to commands and wait this duration before killing them, or kill immediately if 0")
+	flagSignals           = flag.String("signals", "INT", "Comma-separated signals that stop the commands, such as INT,TERM,HUP, or none if empty")
+	flagForwardSignals    = flag.Bool("forward-signals", false, "Forward the signal that stops the commands to them and wait grace-period before killing them")
+	flagTags              = flag.String("tags", "", "Comma-separated tags, only run the commands that have any of them")
+	flagStartRate         = flag.String("start-rate", "", "Maximum rate of command starts as starts/interval, such as 8/1s, overriding the config")
+	flagStartBurst        = flag.Int("start-burst", 0, "Maximum number of commands to start at once with start-rate, or the starts of start-rate if 0")
+	flagDurationHistory   = flag.String("duration-history", "", "A file to record the durations of commands in, used to start the longest commands first")
 
-	errUsage               = fmt.Errorf("usage: %s configFile", os.Args[0])
-	errConfigNil           = errors.New("config is nil")
-	errConfigCommandsEmpty = errors.New("config commands is empty")
-)
+	signalNames = map[string]os.Signal{
+		"INT":  os.Interrupt,
+		"TERM": syscall.SIGTERM,
+		"HUP":  syscall.SIGHUP,
+		"QUIT": syscall.SIGQUIT,
+	}
 
-type config struct {
-	Dir      string   `json:"dir,omitempty" yaml:"dir,omitempty"`
-	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty"`
-}
+	errUsage                = fmt.Errorf("usage: %s configFile", os.Args[0])
+	errMinConcurrentCmdsMax = errors.New("min-concurrent-cmds requires max-concurrent-cmds")
+)
 
 func main() {
 	log.SetFlags(0)
@@ -67,6 +90,11 @@ func do() error {
 	if len(flag.Args()) != 1 {
 		log.Fatal(errUsage.Error())
 	}
+	switch *flagOutput {
+	case outputDirect, outputPrefixed, outputGrouped:
+	default:
+		return fmt.Errorf("invalid output mode: %s", *flagOutput)
+	}
 	config, err := readConfig(flag.Args()[0])
 	if err != nil {
 		return err
@@ -78,73 +106,171 @@ func do() error {
 		}
 		log.Print(string(data))
 	}
-	cmds, err := getCmds(config, *flagDir)
+	dirPath := *flagDir
+	if dirPath == "" {
+		dirPath = config.Dir
+	}
+	eventHandler := parallel.DefaultEventHandler
+	if *flagNoLog {
+		eventHandler = func(*parallel.Event) {}
+	}
+	signals, err := getSignals(*flagSignals)
 	if err != nil {
 		return err
 	}
-	runnerOptions := []parallel.RunnerOption{parallel.WithMaxConcurrentCmds(*flagMaxConcurrentCmds)}
-	if *flagNoLog {
-		runnerOptions = append(runnerOptions, parallel.WithEventHandler(func(*parallel.Event) {}))
+	runnerOptions := []parallel.RunnerOption{parallel.WithSignals(signals...)}
+	if *flagForwardSignals {
+		runnerOptions = append(runnerOptions, parallel.WithSignalForwarding(*flagGracePeriod))
 	}
-	if *flagFastFail {
-		runnerOptions = append(runnerOptions, parallel.WithFastFail())
+	startRateConfig := config.StartRate
+	if *flagStartRate != "" {
+		if startRateConfig, err = parseStartRate(*flagStartRate); err != nil {
+			return err
+		}
+		startRateConfig.Burst = *flagStartBurst
 	}
-	return parallel.NewRunner(runnerOptions...).Run(parallel.ExecCmds(cmds))
-}
-
-func readConfig(configFilePath string) (*config, error) {
-	data, err := ioutil.ReadFile(configFilePath)
+	startRate, err := getStartRate(startRateConfig)
+	if err != nil {
+		return err
+	}
+	if startRate != nil {
+		runnerOptions = append(runnerOptions, parallel.WithStartRate(*startRate))
+	}
+	failureThresholdConfig := config.FailureThreshold
+	if *flagMaxFailures != 0 || *flagMaxFailurePercent != 0 {
+		failureThresholdConfig = &failureThreshold{Failures: *flagMaxFailures, Percent: *flagMaxFailurePercent}
+	}
+	failureThreshold, err := getFailureThreshold(failureThresholdConfig)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if failureThreshold != nil {
+		runnerOptions = append(runnerOptions, parallel.WithFailureThreshold(*failureThreshold))
+	}
+	for name, capacity := range config.ResourcePools {
+		runnerOptions = append(runnerOptions, parallel.WithResourcePool(name, capacity))
+	}
+	var durationHistory *parallel.DurationHistory
+	if *flagDurationHistory != "" {
+		durationHistory, err = parallel.ReadDurationHistory(*flagDurationHistory)
+		if err != nil {
+			return err
+		}
+		logEventHandler := eventHandler
+		eventHandler = func(event *parallel.Event) {
+			logEventHandler(event)
+			durationHistory.HandleEvent(event)
+		}
+		runnerOptions = append(runnerOptions, parallel.WithSchedulingOrder(parallel.LongestFirst(durationHistory)))
 	}
-	config := &config{}
-	if err := yaml.Unmarshal(data, config); err != nil {
-		return nil, err
+	runnerOptions = append(runnerOptions, parallel.WithEventHandler(eventHandler))
+	runStage := func(stage *stage) error {
+		return runCommands(stage, dirPath, config.CgroupParent, runnerOptions...)
 	}
-	if config.Dir == "" {
-		config.Dir = filepath.Dir(configFilePath)
-	} else if !filepath.IsAbs(config.Dir) {
-		config.Dir = filepath.Join(filepath.Dir(configFilePath), config.Dir)
+	if len(config.Stages) == 0 {
+		err = runStage(&stage{Commands: config.Commands})
+	} else {
+		err = runStages(config.Stages, eventHandler, time.Now, runStage)
 	}
-	if err := validateConfig(config); err != nil {
-		return nil, err
+	// the durations of a failed run are still useful
+	if durationHistory != nil {
+		if writeErr := durationHistory.WriteFile(*flagDurationHistory); writeErr != nil && err == nil {
+			err = writeErr
+		}
 	}
-	return config, nil
+	return err
 }
 
-func validateConfig(config *config) error {
-	if config == nil {
-		return errConfigNil
+// runCommands runs the commands of the stage with a new Runner that
+// has the given options, and the options from the flags and the stage.
+func runCommands(stage *stage, dirPath string, cgroupParent string, runnerOptions ...parallel.RunnerOption) error {
+	var execCmdOptions []parallel.ExecCmdOption
+	// orphans are only reaped from the process groups of the commands
+	if *flagProcessGroup || *flagChildSubreaper {
+		execCmdOptions = append(execCmdOptions, parallel.WithProcessGroup())
+	}
+	tasks, err := getTasks(stage.Commands, dirPath, cgroupParent, getTags(*flagTags), *flagRetryBackoff, execCmdOptions...)
+	if err != nil {
+		return err
+	}
+	maxConcurrentCmds := *flagMaxConcurrentCmds
+	if stage.MaxConcurrentCmds != nil {
+		maxConcurrentCmds = *stage.MaxConcurrentCmds
+	}
+	fastFail := *flagFastFail
+	if stage.FastFail != nil {
+		fastFail = *stage.FastFail
+	}
+	runnerOptions = append(
+		// copied since the options are shared by all the stages
+		append([]parallel.RunnerOption{}, runnerOptions...),
+		parallel.WithMaxConcurrentCmds(maxConcurrentCmds),
+		parallel.WithCmdTimeout(*flagCmdTimeout),
+		parallel.WithRunTimeout(*flagRunTimeout),
+	)
+	if *flagMinConcurrentCmds > 0 {
+		if maxConcurrentCmds == 0 {
+			return errMinConcurrentCmdsMax
+		}
+		runnerOptions = append(runnerOptions, parallel.WithAdaptiveConcurrency(parallel.AdaptiveConcurrency{
+			MinConcurrentCmds: *flagMinConcurrentCmds,
+			MaxConcurrentCmds: maxConcurrentCmds,
+		}))
 	}
-	if len(config.Commands) == 0 {
-		return errConfigCommandsEmpty
+	if fastFail {
+		runnerOptions = append(runnerOptions, parallel.WithFastFail())
+	}
+	if *flagGracePeriod > 0 {
+		runnerOptions = append(runnerOptions, parallel.WithGracefulTermination(syscall.SIGTERM, *flagGracePeriod))
+	}
+	if *flagRetries > 0 {
+		runnerOptions = append(runnerOptions, parallel.WithRetryPolicy(parallel.RetryPolicy{
+			MaxAttempts:       *flagRetries + 1,
+			Backoff:           *flagRetryBackoff,
+			BackoffMultiplier: 2,
+		}))
+	}
+	switch *flagOutput {
+	case outputDirect:
+	case outputPrefixed:
+		var prefixedOutputOptions []parallel.PrefixedOutputOption
+		if *flagOutputColor {
+			prefixedOutputOptions = append(prefixedOutputOptions, parallel.WithColor())
+		}
+		runnerOptions = append(runnerOptions, parallel.WithOutput(parallel.NewPrefixedOutput(os.Stdout, os.Stderr, prefixedOutputOptions...)))
+	case outputGrouped:
+		runnerOptions = append(runnerOptions, parallel.WithOutput(parallel.NewGroupedOutput(os.Stdout)))
+	}
+	if *flagChildSubreaper {
+		runnerOptions = append(runnerOptions, parallel.WithChildSubreaper())
 	}
-	return nil
+	return parallel.NewRunner(runnerOptions...).RunTasks(context.Background(), tasks)
 }
 
-func getCmds(config *config, dirPath string) ([]*exec.Cmd, error) {
-	var cmds []*exec.Cmd
-	for _, line := range config.Commands {
-		if line == "" {
-			continue
-		}
-		args, err := shellwords.Parse(line)
-		if err != nil {
-			return nil, err
+func getTags(tagsString string) []string {
+	var tags []string
+	for _, tag := range strings.Split(tagsString, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
 		}
-		// could happen if args = "$FOO" and FOO is not set
-		if len(args) == 0 {
+	}
+	return tags
+}
+
+// getSignals returns the signals with the given comma-separated
+// names, with or without the SIG prefix.
+func getSignals(signalsString string) ([]os.Signal, error) {
+	var signals []os.Signal
+	for _, name := range strings.Split(signalsString, ",") {
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+		if name == "" {
 			continue
 		}
-		cmd := exec.Command(args[0], args[1:]...)
-		if dirPath != "" {
-			cmd.Dir = dirPath
-		} else {
-			cmd.Dir = config.Dir
+		sig, ok := signalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal: %s", name)
 		}
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmds = append(cmds, cmd)
+		signals = append(signals, sig)
 	}
-	return cmds, nil
+	return signals, nil
 }
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/tools/lib/parallel"
+)
+
+// runStages runs the stages in order with runStage, and stops after
+// the first stage that fails.
+//
+// A stage_started and stage_finished Event is sent to eventHandler
+// for every stage that is run.
+func runStages(
+	stages []*stage,
+	eventHandler func(*parallel.Event),
+	clock func() time.Time,
+	runStage func(*stage) error,
+) error {
+	for i, stage := range stages {
+		startTime := clock()
+		eventHandler(newStageStartedEvent(startTime, i, stage))
+		err := runStage(stage)
+		eventHandler(newStageFinishedEvent(clock(), startTime, i, stage, err))
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", getLocation("", "stages", i, stage.Name), err)
+		}
+	}
+	return nil
+}
+
+func newStageStartedEvent(t time.Time, index int, stage *stage) *parallel.Event {
+	return &parallel.Event{
+		Type:   parallel.EventTypeStageStarted,
+		Time:   t,
+		Fields: getStageFields(index, stage),
+	}
+}
+
+func newStageFinishedEvent(t time.Time, startTime time.Time, index int, stage *stage, err error) *parallel.Event {
+	fields := getStageFields(index, stage)
+	fields["duration"] = t.Sub(startTime).String()
+	event := &parallel.Event{
+		Type:     parallel.EventTypeStageFinished,
+		Time:     t,
+		Duration: t.Sub(startTime),
+		Fields:   fields,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+func getStageFields(index int, stage *stage) map[string]interface{} {
+	fields := map[string]interface{}{
+		"stage": index,
+	}
+	if stage.Name != "" {
+		fields["name"] = stage.Name
+	}
+	return fields
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/tools/lib/parallel"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStages(t *testing.T) {
+	stages := []*stage{
+		{Name: "lint"},
+		{},
+		{Name: "integration"},
+	}
+	var events []*parallel.Event
+	var ran []int
+	err := runStages(
+		stages,
+		func(event *parallel.Event) { events = append(events, event) },
+		func() time.Time { return time.Unix(0, 0) },
+		func(stage *stage) error {
+			for i := range stages {
+				if stages[i] == stage {
+					ran = append(ran, i)
+				}
+			}
+			if stage == stages[1] {
+				return errors.New("failed")
+			}
+			return nil
+		},
+	)
+	require.Error(t, err)
+	assert.Equal(t, "stages[1] failed: failed", err.Error())
+	assert.Equal(t, []int{0, 1}, ran)
+	require.Len(t, events, 4)
+	assert.Equal(t, parallel.EventTypeStageStarted, events[0].Type)
+	assert.Equal(t, map[string]interface{}{"stage": 0, "name": "lint"}, events[0].Fields)
+	assert.Equal(t, parallel.EventTypeStageFinished, events[1].Type)
+	assert.Equal(t, map[string]interface{}{"stage": 0, "name": "lint", "duration": "0s"}, events[1].Fields)
+	assert.Empty(t, events[1].Error)
+	assert.Equal(t, parallel.EventTypeStageStarted, events[2].Type)
+	assert.Equal(t, parallel.EventTypeStageFinished, events[3].Type)
+	assert.Equal(t, "failed", events[3].Error)
+}